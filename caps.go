@@ -0,0 +1,113 @@
+package eventsource
+
+import "sync"
+
+// connectionCaps counts the consumers connected with every connection key
+// for Settings.MaxConnectionsPerKey.
+type connectionCaps struct {
+	lock  sync.Mutex
+	max   int
+	evict bool
+
+	// counts are the slots taken per key, including the ones reserved for
+	// consumers being connected
+	counts map[string]int
+
+	// consumers are the connected consumers per key, oldest first, keys
+	// are the keys of the consumers by id
+	consumers map[string][]*consumer
+	keys      map[ConsumerID]string
+}
+
+func newConnectionCaps(max int, evict bool) *connectionCaps {
+	return &connectionCaps{
+		max:       max,
+		evict:     evict,
+		counts:    make(map[string]int),
+		consumers: make(map[string][]*consumer),
+		keys:      make(map[ConsumerID]string),
+	}
+}
+
+// reserve takes a slot for a new consumer with the key, it reports false
+// if there is none left. If the oldest consumer with the key has to be
+// evicted to make room for it, its slot is handed over and it's returned,
+// the caller closes it.
+func (cc *connectionCaps) reserve(key string) (bool, *consumer) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	if cc.counts[key] < cc.max {
+		cc.counts[key]++
+		return true, nil
+	}
+	consumers := cc.consumers[key]
+	if !cc.evict || len(consumers) == 0 {
+		return false, nil
+	}
+	oldest := consumers[0]
+	cc.forget(key, oldest)
+	return true, oldest
+}
+
+// unreserve frees a slot reserved for a consumer which couldn't be
+// connected.
+func (cc *connectionCaps) unreserve(key string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	cc.free(key)
+}
+
+// track records the consumer connected in the slot reserved for it. The
+// slot is freed right away if the consumer goroutine has exited already.
+func (cc *connectionCaps) track(key string, c *consumer) {
+	cc.lock.Lock()
+	cc.consumers[key] = append(cc.consumers[key], c)
+	cc.keys[c.id] = key
+	cc.lock.Unlock()
+
+	select {
+	case <-c.done:
+		cc.release(c)
+	default:
+	}
+}
+
+// release frees the slot of the consumer unless it has been handed over.
+// It's called once the consumer goroutine has closed done, and may be
+// called more than once.
+func (cc *connectionCaps) release(c *consumer) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	key, ok := cc.keys[c.id]
+	if !ok {
+		return
+	}
+	cc.forget(key, c)
+	cc.free(key)
+}
+
+// forget removes the consumer from the consumers of the key.
+func (cc *connectionCaps) forget(key string, c *consumer) {
+	delete(cc.keys, c.id)
+	consumers := cc.consumers[key]
+	for i, other := range consumers {
+		if other == c {
+			consumers = append(consumers[:i], consumers[i+1:]...)
+			break
+		}
+	}
+	if len(consumers) == 0 {
+		delete(cc.consumers, key)
+	} else {
+		cc.consumers[key] = consumers
+	}
+}
+
+func (cc *connectionCaps) free(key string) {
+	if cc.counts[key]--; cc.counts[key] <= 0 {
+		delete(cc.counts, key)
+	}
+}
@@ -0,0 +1,176 @@
+package eventsource
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compressor compresses a stream, e.g. a *gzip.Writer, a brotli or a zstd
+// writer. Flush writes the data compressed so far, so every message is
+// delivered right away, and Close writes the end of the stream.
+type Compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// Encoding is a Content-Encoding streams are compressed with for clients
+// accepting it, see Settings.Encodings.
+type Encoding struct {
+	// Name is the content coding, e.g. "br" or "zstd".
+	Name string
+
+	// NewCompressor returns a compressor writing to w.
+	NewCompressor func(w io.Writer) Compressor
+}
+
+// encoder creates the compressors of an encoding, release is called with
+// every compressor once it's closed, it may be nil.
+type encoder struct {
+	name    string
+	new     func(w io.Writer) Compressor
+	release func(c Compressor)
+}
+
+// newEncoders returns the encoders of encodings in preference order, then
+// the gzip one if withGzip is set.
+func newEncoders(encodings []Encoding, withGzip bool, gzipLevel int) []*encoder {
+	var encoders []*encoder
+	for _, encoding := range encodings {
+		if encoding.Name == "" || encoding.NewCompressor == nil {
+			continue
+		}
+		encoders = append(encoders, &encoder{name: strings.ToLower(encoding.Name), new: encoding.NewCompressor})
+	}
+	if withGzip {
+		pool := newGzipPool(gzipLevel)
+		encoders = append(encoders, &encoder{
+			name:    "gzip",
+			new:     func(w io.Writer) Compressor { return pool.get(w) },
+			release: func(c Compressor) { pool.put(c.(*gzip.Writer)) },
+		})
+	}
+	return encoders
+}
+
+// encoder returns the preferred encoder accepted by the Accept-Encoding
+// header of req, the most preferred one if req is nil, or nil if the stream
+// isn't compressed.
+func (es *eventSource) encoder(req *http.Request) *encoder {
+	if len(es.encoders) == 0 {
+		return nil
+	}
+	if req == nil {
+		return es.encoders[0]
+	}
+	accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+	for _, enc := range es.encoders {
+		q, ok := accepted[enc.name]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return enc
+		}
+	}
+	return nil
+}
+
+// acceptedEncodings parses an Accept-Encoding header into the quality value
+// of every listed content coding.
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if key, value, ok := strings.Cut(params, "="); ok && strings.TrimSpace(key) == "q" {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = v
+			}
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
+
+// compressConn compresses writes to the connection, the compressor is
+// released once the connection is closed.
+type compressConn struct {
+	net.Conn
+	Compressor
+
+	enc       *encoder
+	closeOnce sync.Once
+}
+
+func newCompressConn(conn net.Conn, enc *encoder) *compressConn {
+	return &compressConn{Conn: conn, Compressor: enc.new(conn), enc: enc}
+}
+
+func (cc *compressConn) Write(b []byte) (int, error) {
+	n, err := cc.Compressor.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	return n, cc.Compressor.Flush()
+}
+
+func (cc *compressConn) Close() error {
+	var err error
+	cc.closeOnce.Do(func() {
+		err = cc.Compressor.Close()
+		if cc.enc.release != nil {
+			cc.enc.release(cc.Compressor)
+		}
+		if err != nil {
+			cc.Conn.Close()
+			return
+		}
+		err = cc.Conn.Close()
+	})
+	return err
+}
+
+// gzipPool reuses gzip writers of a compression level across connections,
+// so connecting clients don't allocate compressor state each.
+type gzipPool struct {
+	level int
+	pool  sync.Pool
+}
+
+// newGzipPool returns the pool of writers of the level, the default
+// compression level if it's invalid or zero.
+func newGzipPool(level int) *gzipPool {
+	if level == 0 || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		level = gzip.DefaultCompression
+	}
+	return &gzipPool{level: level}
+}
+
+// get returns a writer compressing to w.
+func (p *gzipPool) get(w io.Writer) *gzip.Writer {
+	if gz, ok := p.pool.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return gz
+	}
+	// the level has been validated
+	gz, _ := gzip.NewWriterLevel(w, p.level)
+	return gz
+}
+
+// put returns the closed writer to the pool, it must not be used anymore.
+func (p *gzipPool) put(gz *gzip.Writer) {
+	// it doesn't keep the previous destination alive
+	gz.Reset(io.Discard)
+	p.pool.Put(gz)
+}
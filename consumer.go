@@ -1,127 +1,658 @@
 package eventsource
 
 import (
-	"compress/gzip"
+	"bytes"
 	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type consumer struct {
-	conn   io.WriteCloser
-	es     *eventSource
-	in     chan []byte
-	staled bool
+	// lastActivity is the time of the last successful write in Unix
+	// nanoseconds, accessed atomically
+	lastActivity int64
+
+	// staled is set to 1 once the consumer is going to be removed,
+	// accessed atomically
+	staled int32
+
+	// inClosed is set to 1 by the one closing in, accessed atomically
+	inClosed int32
+
+	// drops is the number of messages dropped because the buffer was
+	// full, accessed atomically
+	drops uint64
+
+	// consecutiveDrops is the number of messages dropped since the last
+	// one queued, waitingSince is when the buffer was last found empty,
+	// they're accessed by the goroutine sending to in only
+	consecutiveDrops int
+	waitingSince     time.Time
+
+	id   ConsumerID
+	conn io.WriteCloser
+	es   *eventSource
+
+	// in is the message buffer, it's replaced by the control goroutine
+	// holding the registry shard lock of the consumer
+	in chan queuedFrame
+
+	// priority is the queue of control messages, such as retry messages
+	// and heartbeats, written before queued data
+	priority chan queuedFrame
+
+	// resize passes a new message buffer to the consumer goroutine, which
+	// acknowledges moving queued messages to it on resized
+	resize  chan chan queuedFrame
+	resized chan bool
+
+	// done is closed when the consumer goroutine exits
+	done chan bool
+
+	// quit is closed to make the consumer goroutine close the connection
+	// and exit without the control goroutine, see stop
+	quit     chan bool
+	quitOnce sync.Once
+
+	// connected is closed once the OnConnect hook returns, so OnDisconnect
+	// is never called before it, announced is set before if the hook has
+	// been called
+	connected chan bool
+	announced bool
+
+	// clientClosed is closed when the client closes the connection, it's
+	// nil unless the client side is watched
+	clientClosed <-chan struct{}
+
+	// filter selects events sent to the consumer, it's accessed by the
+	// control goroutine only
+	filter func(e Event) bool
+
+	// capabilities advertised by the client in the "features" query
+	// parameter
+	capabilities []string
+
+	// channels the consumer is subscribed to in the "channels" query
+	// parameter
+	channels []string
+
+	// lastEventID is the Last-Event-ID header of the request, or the id of
+	// the last OnConnectSend event, events following it are replayed from
+	// the event store
+	lastEventID string
+
+	// metadata the consumer is tagged with, it isn't modified once the
+	// consumer has been added
+	metadata map[string]string
+
+	// initial are the events returned by the OnConnectSend hook, queued
+	// when the consumer is added
+	initial []*eventMessage
+
+	// remoteAddr and userAgent identify the client, connectedAt is when
+	// the consumer has been created, they're set once
+	remoteAddr  string
+	userAgent   string
+	connectedAt time.Time
+
+	// header is a copy of the request headers, nil for consumers attached
+	// without a request
+	header http.Header
+
+	// value holds the consumerValue set by SetConsumerValue
+	value atomic.Value
+
+	// contentType is the negotiated content type of the stream, serializer
+	// frames messages for it or is nil for SSE
+	contentType string
+	serializer  Serializer
+
+	lastErrLock sync.Mutex
+	lastErr     error
 }
 
-type gzipConn struct {
-	net.Conn
-	*gzip.Writer
+// queuedFrame is a frame waiting in a consumer buffer.
+type queuedFrame struct {
+	data []byte
+
+	// expires is when the frame is skipped instead of written, in Unix
+	// nanoseconds, or 0
+	expires int64
 }
 
-func (gc gzipConn) Write(b []byte) (int, error) {
-	n, err := gc.Writer.Write(b)
-	if err != nil {
-		return n, err
+// newQueuedFrame returns the frame expiring after ttl if positive.
+func newQueuedFrame(frame []byte, ttl time.Duration) queuedFrame {
+	qf := queuedFrame{data: frame}
+	if ttl > 0 {
+		qf.expires = time.Now().Add(ttl).UnixNano()
 	}
+	return qf
+}
 
-	return n, gc.Writer.Flush()
+func (qf queuedFrame) expired(now time.Time) bool {
+	return qf.expires != 0 && now.UnixNano() > qf.expires
 }
 
-func (gc gzipConn) Close() error {
-	err := gc.Writer.Close()
-	if err != nil {
-		return err
+// messageTTL returns how long frames of the message may wait in consumer
+// buffers, 0 if they don't expire.
+func messageTTL(m message) time.Duration {
+	switch m := m.(type) {
+	case *eventMessage:
+		return m.ttl
+	case *batchMessage:
+		return m.ttl
 	}
+	return 0
+}
 
-	return gc.Conn.Close()
+func (c *consumer) dropped(n uint64) {
+	atomic.AddUint64(&c.drops, n)
 }
 
-func newConsumer(resp http.ResponseWriter, req *http.Request, es *eventSource) (*consumer, error) {
-	conn, _, err := resp.(http.Hijacker).Hijack()
-	if err != nil {
-		return nil, err
+func (c *consumer) isStaled() bool {
+	return atomic.LoadInt32(&c.staled) != 0
+}
+
+// markStaled marks the consumer as staled and reports whether it wasn't
+// staled before. Only the caller which marked it may pass it to the
+// staled channel.
+func (c *consumer) markStaled() bool {
+	return atomic.CompareAndSwapInt32(&c.staled, 0, 1)
+}
+
+// stale marks the consumer as staled and queues it for removal.
+func (c *consumer) stale() {
+	if c.markStaled() {
+		select {
+		case c.es.staled <- c:
+		case <-c.es.stopped:
+		}
 	}
+}
 
-	consumer := &consumer{
-		conn:   conn,
-		es:     es,
-		in:     make(chan []byte, 10),
-		staled: false,
+// stop marks the consumer as staled and makes its goroutine close the
+// connection and exit. The consumer is left for the control goroutine to
+// remove. It may be called more than once.
+func (c *consumer) stop() {
+	c.markStaled()
+	c.quitOnce.Do(func() { close(c.quit) })
+}
+
+// closeIn closes the message buffer, making the consumer goroutine exit
+// once it has written queued messages. It may be called more than once.
+func (c *consumer) closeIn() {
+	if atomic.CompareAndSwapInt32(&c.inClosed, 0, 1) {
+		close(c.in)
 	}
+}
 
-	_, err = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n"))
-	if err != nil {
-		conn.Close()
-		return nil, err
+// filtered returns the message as filtered for the consumer, or nil if
+// it doesn't pass the consumer filter. Only events are filtered, a batch
+// is reduced to the events passing the filter.
+func (c *consumer) filtered(m message) message {
+	if c.filter == nil {
+		return m
 	}
+	switch m := m.(type) {
+	case *eventMessage:
+		if !c.accepts(m) {
+			return nil
+		}
+	case *batchMessage:
+		var accepted []*eventMessage
+		for i, em := range m.events {
+			if !c.accepts(em) {
+				if accepted == nil {
+					accepted = append(make([]*eventMessage, 0, len(m.events)), m.events[:i]...)
+				}
+				continue
+			}
+			if accepted != nil {
+				accepted = append(accepted, em)
+			}
+		}
+		if accepted == nil {
+			// all the events passed
+			return m
+		}
+		if len(accepted) == 0 {
+			return nil
+		}
+		return newBatchMessage(accepted, m.terminator)
+	}
+	return m
+}
 
-	_, err = conn.Write([]byte("Vary: Accept-Encoding\r\n"))
-	if err != nil {
-		conn.Close()
-		return nil, err
+// accepts reports whether the event passes the consumer filter.
+func (c *consumer) accepts(m *eventMessage) bool {
+	return c.filter == nil || c.filter(Event{ID: m.id, Type: m.event, Data: m.data})
+}
+
+func (c *consumer) setLastErr(err error) {
+	c.lastErrLock.Lock()
+	defer c.lastErrLock.Unlock()
+
+	c.lastErr = err
+}
+
+// lastError returns the last error encountered writing to the consumer.
+func (c *consumer) lastError() error {
+	c.lastErrLock.Lock()
+	defer c.lastErrLock.Unlock()
+
+	return c.lastErr
+}
+
+// moveMessages moves queued messages from in to newIn, dropping the ones
+// which don't fit, and returns newIn.
+func (c *consumer) moveMessages(in, newIn chan queuedFrame) chan queuedFrame {
+	for {
+		select {
+		case message := <-in:
+			select {
+			case newIn <- message:
+			default:
+				c.es.stats.unqueued(len(message.data))
+			}
+		default:
+			return newIn
+		}
 	}
+}
 
-	if es.gzip && (req == nil || strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")) {
-		_, err = conn.Write([]byte("Content-Encoding: gzip\r\n"))
-		if err != nil {
-			conn.Close()
+// batch appends messages queued in in to batch until it reaches
+// MaxBatchSize, waiting up to FlushInterval for more, and records their
+// sizes. Expired messages are skipped. It reports whether in has been
+// closed.
+func (c *consumer) batch(in chan queuedFrame, batch []byte, sizes []int) ([]byte, []int, bool) {
+	var flush <-chan time.Time
+	if c.es.flushInterval > 0 {
+		timer := time.NewTimer(c.es.flushInterval)
+		defer timer.Stop()
+		flush = timer.C
+	}
+
+	for len(batch) < c.es.maxBatchSize {
+		var message queuedFrame
+		var open bool
+		if flush == nil {
+			select {
+			case message, open = <-in:
+			default:
+				return batch, sizes, false
+			}
+		} else {
+			select {
+			case message, open = <-in:
+			case <-flush:
+				return batch, sizes, false
+			}
+		}
+		if !open {
+			return batch, sizes, true
+		}
+		c.es.stats.unqueued(len(message.data))
+		if message.expired(time.Now()) {
+			c.es.stats.expire()
+			continue
+		}
+		batch = append(batch, message.data...)
+		sizes = append(sizes, len(message.data))
+	}
+	return batch, sizes, false
+}
+
+// discardQueued discards the messages queued in in and the priority
+// queue, it returns once in is empty or closed.
+func (c *consumer) discardQueued(in chan queuedFrame) {
+	for drained := false; !drained; {
+		select {
+		case message := <-c.priority:
+			c.es.stats.unqueued(len(message.data))
+		default:
+			drained = true
+		}
+	}
+	for {
+		select {
+		case message, open := <-in:
+			if !open {
+				return
+			}
+			c.es.stats.unqueued(len(message.data))
+		default:
+			return
+		}
+	}
+}
+
+// splitList returns the non-empty items of a comma separated list.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// register adds the consumer to the event source, then calls the
+// OnConnect hook. Messages sent from the hook reach the consumer since
+// pending consumers are added before dispatching messages. The consumer
+// is closed and ErrClosed is returned if the event source is closed.
+func (c *consumer) register(req *http.Request) error {
+	select {
+	case c.es.add <- c:
+	case <-c.es.stopped:
+		c.closeIn()
+		close(c.connected)
+		return ErrClosed
+	}
+	select {
+	case <-c.es.stopped:
+		// the control goroutine may have stopped before taking it
+		c.closeIn()
+		close(c.connected)
+		return ErrClosed
+	default:
+	}
+
+	c.announced = true
+	if c.es.onConnect != nil {
+		c.es.onConnect(req, c.id)
+	}
+	close(c.connected)
+	return nil
+}
+
+// newConsumer hijacks the connection, or streams through the response if
+// it can't be hijacked, e.g. over HTTP/2. header is added to the response
+// headers.
+func newConsumer(resp http.ResponseWriter, req *http.Request, es *eventSource, header http.Header) (*consumer, error) {
+	if hijacker, ok := resp.(http.Hijacker); ok {
+		conn, _, err := hijacker.Hijack()
+		if err == nil {
+			return attachConsumer(conn, req, es, header)
+		}
+		if err != http.ErrNotSupported {
+			es.reportError(0, err)
 			return nil, err
 		}
+	}
+
+	conn, err := newResponseConn(resp, req, es, header)
+	if err != nil {
+		es.reportError(0, err)
+		return nil, err
+	}
+	return attachConsumer(conn, req, es, nil)
+}
 
-		consumer.conn = gzipConn{conn, gzip.NewWriter(conn)}
+// responseHeaders returns the whole response header block of a stream of
+// contentType for req, including header, and the encoder the stream is
+// compressed with, or nil.
+func (es *eventSource) responseHeaders(req *http.Request, contentType string, header http.Header) ([]byte, *encoder) {
+	var headers bytes.Buffer
+	headers.WriteString("HTTP/1.1 200 OK\r\nContent-Type: " + contentType + "\r\n")
+	if len(es.serializers) > 0 {
+		headers.WriteString("Vary: Accept, Accept-Encoding\r\n")
+	} else {
+		headers.WriteString("Vary: Accept-Encoding\r\n")
 	}
+	// the body is delimited by closing the connection
+	headers.WriteString("Connection: close\r\n")
+
+	enc := es.encoder(req)
+	if enc != nil {
+		headers.WriteString("Content-Encoding: " + enc.name + "\r\n")
+	}
+
+	header.Write(&headers)
 
 	if es.customHeadersFunc != nil {
 		for _, header := range es.customHeadersFunc(req) {
-			_, err = conn.Write(header)
-			if err != nil {
-				conn.Close()
-				return nil, err
-			}
-			_, err = conn.Write([]byte("\r\n"))
-			if err != nil {
-				conn.Close()
-				return nil, err
+			headers.Write(header)
+			headers.WriteString("\r\n")
+		}
+	}
+
+	headers.WriteString("\r\n")
+	return headers.Bytes(), enc
+}
+
+// attachConsumer starts streaming to conn. If header is nil, the HTTP
+// response header block is skipped and the stream isn't compressed.
+func attachConsumer(conn net.Conn, req *http.Request, es *eventSource, header http.Header) (*consumer, error) {
+	now := time.Now()
+	consumer := &consumer{
+		lastActivity: now.UnixNano(),
+		connectedAt:  now,
+		id:           es.nextConsumerID(),
+		conn:         conn,
+		es:           es,
+		in:           make(chan queuedFrame, es.consumerBufferSize),
+		priority:     make(chan queuedFrame, priorityBufferSize),
+		resize:       make(chan chan queuedFrame),
+		resized:      make(chan bool),
+		done:         make(chan bool),
+		quit:         make(chan bool),
+		connected:    make(chan bool),
+	}
+
+	consumer.contentType, consumer.serializer = es.negotiate(req)
+	if req != nil {
+		consumer.remoteAddr = req.RemoteAddr
+		consumer.userAgent = req.UserAgent()
+		consumer.header = req.Header.Clone()
+	} else if addr := conn.RemoteAddr(); addr != nil {
+		consumer.remoteAddr = addr.String()
+	}
+	if req != nil && es.store != nil {
+		consumer.lastEventID = req.Header.Get("Last-Event-ID")
+	}
+	if req != nil && es.consumerMetadata != nil {
+		consumer.metadata = es.consumerMetadata(req)
+	}
+	if req != nil && es.onConnectSend != nil {
+		for _, e := range es.onConnectSend(req) {
+			if es.validate(e.Type, e.ID) != nil {
+				continue
 			}
+			consumer.initial = append(consumer.initial, es.newEvent(e))
+		}
+		// the stored events following the snapshot are replayed
+		if n := len(consumer.initial); n > 0 && es.store != nil && consumer.lastEventID == "" {
+			consumer.lastEventID = consumer.initial[n-1].id
+		}
+	}
+	if req != nil && es.consumerFilter != nil {
+		filter := es.consumerFilter
+		consumer.filter = func(e Event) bool {
+			return filter(req, e)
 		}
 	}
 
-	_, err = conn.Write([]byte("\r\n"))
-	if err != nil {
-		conn.Close()
-		return nil, err
+	if req != nil {
+		query := req.URL.Query()
+		consumer.capabilities = splitList(query.Get("features"))
+		consumer.channels = splitList(query.Get("channels"))
+	}
+
+	if header != nil {
+		headers, enc := es.responseHeaders(req, consumer.contentType, header)
+		if enc != nil {
+			consumer.conn = newCompressConn(conn, enc)
+		}
+		_, err := conn.Write(headers)
+		if err != nil {
+			es.reportError(consumer.id, err)
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if rc, ok := conn.(*responseConn); ok {
+		// the request context is canceled once the client goes away,
+		// e.g. an HTTP/2 stream is reset
+		consumer.clientClosed = rc.req.Context().Done()
+	} else if es.watchClientClose {
+		clientClosed := make(chan struct{})
+		consumer.clientClosed = clientClosed
+		go func() {
+			// reading fails once the client closes the connection or
+			// the consumer closes it
+			io.Copy(io.Discard, conn)
+			close(clientClosed)
+		}()
 	}
 
+	es.stats.connected(req != nil && req.Header.Get("Last-Event-ID") != "")
+
+	// the goroutine has been reserved by the caller
 	go func() {
+		defer es.stats.releaseGoroutine()
+		if es.connectionCaps != nil {
+			// it runs once done is closed, see connectionCaps.track
+			defer es.connectionCaps.release(consumer)
+		}
+		defer close(consumer.done)
+		defer func() {
+			es.logger.Info("Consumer disconnected", "consumer", consumer.id, "error", consumer.lastError())
+		}()
+		if es.onDisconnect != nil {
+			defer func() {
+				<-consumer.connected
+				if !consumer.announced {
+					return
+				}
+				es.onDisconnect(consumer.id, consumer.lastError())
+			}()
+		}
 		idleTimer := time.NewTimer(es.idleTimeout)
 		defer idleTimer.Stop()
+		// keepAlive is nil unless keepalive comments are enabled and the
+		// stream format has comments
+		var keepAliveTimer *time.Timer
+		var keepAlive <-chan time.Time
+		keepAliveFrame := es.serialize(consumer.serializer, &commentMessage{comment: "keepalive"})
+		if es.keepAliveInterval > 0 && len(keepAliveFrame) > 0 {
+			keepAliveTimer = time.NewTimer(es.keepAliveInterval)
+			defer keepAliveTimer.Stop()
+			keepAlive = keepAliveTimer.C
+		}
+		in := consumer.in
+		// messages left after a failed write are never written
+		defer func() { consumer.discardQueued(in) }()
+		// batch and sizes are reused for coalescing messages
+		var batch []byte
+		var sizes []int
 		for {
+			var queued queuedFrame
+			var open bool
+			// priority messages are written first
 			select {
-			case message, open := <-consumer.in:
-				if !open {
+			case queued = <-consumer.priority:
+				open = true
+			default:
+				select {
+				case newIn := <-consumer.resize:
+					in = consumer.moveMessages(in, newIn)
+					consumer.resized <- true
+					continue
+				case queued = <-consumer.priority:
+					open = true
+				case queued, open = <-in:
+				case <-keepAlive:
+					// keepalive comments don't count as activity
+					conn.SetWriteDeadline(time.Now().Add(consumer.es.timeout))
+					if _, err := consumer.conn.Write(keepAliveFrame); err != nil {
+						consumer.setLastErr(err)
+						es.reportError(consumer.id, err)
+						consumer.conn.Close()
+						consumer.stale()
+						return
+					}
+					keepAliveTimer.Reset(es.keepAliveInterval)
+					continue
+				case <-consumer.quit:
+					consumer.setLastErr(ErrClosed)
 					consumer.conn.Close()
 					return
+				case <-consumer.clientClosed:
+					consumer.setLastErr(ErrClientClosed)
+					consumer.conn.Close()
+					consumer.stale()
+					return
+				case <-idleTimer.C:
+					consumer.setLastErr(ErrIdleTimeout)
+					es.reportError(consumer.id, ErrIdleTimeout)
+					consumer.conn.Close()
+					consumer.stale()
+					return
 				}
-				conn.SetWriteDeadline(time.Now().Add(consumer.es.timeout))
-				_, err := consumer.conn.Write(message)
-				if err != nil {
-					netErr, ok := err.(net.Error)
-					if !ok || !netErr.Timeout() || consumer.es.closeOnTimeout {
-						consumer.staled = true
-						consumer.conn.Close()
-						consumer.es.staled <- consumer
-						return
+			}
+			if !open {
+				if len(consumer.priority) > 0 {
+					continue
+				}
+				consumer.markStaled()
+				consumer.conn.Close()
+				return
+			}
+			es.stats.unqueued(len(queued.data))
+			if queued.expired(time.Now()) {
+				// it's too late to deliver it
+				es.stats.expire()
+				continue
+			}
+			message := queued.data
+			sizes = append(sizes[:0], len(message))
+			closed := false
+			if es.maxBatchSize > 0 {
+				batch, sizes, closed = consumer.batch(in, append(batch[:0], message...), sizes)
+				message = batch
+			}
+			conn.SetWriteDeadline(time.Now().Add(consumer.es.timeout))
+			start := time.Now()
+			_, err := consumer.conn.Write(message)
+			es.stats.writeLatency.observe(time.Since(start))
+			if err != nil {
+				consumer.setLastErr(err)
+				es.logger.Info("Can't write to a consumer", "consumer", consumer.id, "bytes", len(message), "error", err)
+				es.reportError(consumer.id, err)
+				netErr, ok := err.(net.Error)
+				if !ok || !netErr.Timeout() || consumer.es.closeOnTimeout {
+					consumer.conn.Close()
+					consumer.stale()
+					return
+				}
+			}
+			if err == nil {
+				if es.onFrame != nil {
+					for _, size := range sizes {
+						es.onFrame(consumer.id, size)
 					}
 				}
-				idleTimer.Reset(es.idleTimeout)
-			case <-idleTimer.C:
+				atomic.StoreInt64(&consumer.lastActivity, time.Now().UnixNano())
+			}
+			if closed {
+				if len(consumer.priority) > 0 {
+					continue
+				}
+				consumer.markStaled()
 				consumer.conn.Close()
-				consumer.es.staled <- consumer
 				return
 			}
+			idleTimer.Reset(es.idleTimeout)
+			if keepAliveTimer != nil {
+				keepAliveTimer.Reset(es.keepAliveInterval)
+			}
 		}
 	}()
 
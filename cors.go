@@ -0,0 +1,70 @@
+package eventsource
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// CORS configures the cross-origin resource sharing headers of responses.
+type CORS struct {
+	// AllowedOrigins lists the origins allowed to connect, "*" allows any
+	// origin. Requests from other origins get no CORS headers, so browsers
+	// refuse them.
+	AllowedOrigins []string
+
+	// AllowCredentials sets whether the browser may send cookies and HTTP
+	// authentication. The request origin is echoed instead of "*" then, as
+	// browsers require.
+	AllowCredentials bool
+
+	// MaxAge sets how long browsers may cache preflight responses, it's
+	// not sent if zero.
+	MaxAge time.Duration
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for the
+// origin, or "" if it isn't allowed.
+func (c *CORS) allowedOrigin(origin string) string {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			if c.AllowCredentials {
+				return origin
+			}
+			return "*"
+		}
+		if allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// addHeaders adds the CORS headers for req to header, including the
+// preflight ones if preflight is true.
+func (c *CORS) addHeaders(header http.Header, req *http.Request, preflight bool) {
+	if c == nil || req == nil {
+		return
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+
+	allowed := c.allowedOrigin(origin)
+	if allowed != "*" {
+		// the response depends on the origin even if it isn't allowed
+		header.Add("Vary", "Origin")
+	}
+	if allowed == "" {
+		return
+	}
+
+	header.Set("Access-Control-Allow-Origin", allowed)
+	if c.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if preflight && c.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+	}
+}
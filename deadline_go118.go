@@ -0,0 +1,14 @@
+//go:build !go1.20
+
+package eventsource
+
+import (
+	"net/http"
+	"time"
+)
+
+// setWriteDeadline does nothing, ResponseWriter doesn't support deadlines
+// before Go 1.20.
+func setWriteDeadline(resp http.ResponseWriter, t time.Time) error {
+	return nil
+}
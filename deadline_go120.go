@@ -0,0 +1,19 @@
+//go:build go1.20
+
+package eventsource
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// setWriteDeadline sets the write deadline of resp, unwrapping it down to
+// the ResponseWriter of the server.
+func setWriteDeadline(resp http.ResponseWriter, t time.Time) error {
+	err := http.NewResponseController(resp).SetWriteDeadline(t)
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+//go:build go1.20
+
+package eventsource
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// deadlineRecorder is a ResponseWriter supporting write deadlines, it
+// records the deadlines set.
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(t time.Time) error {
+	r.deadlines = append(r.deadlines, t)
+	return nil
+}
+
+// wrappedWriter is a middleware ResponseWriter, unwrapped by
+// http.ResponseController.
+type wrappedWriter struct {
+	http.ResponseWriter
+}
+
+func (w wrappedWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestResponseConnWriteDeadline(t *testing.T) {
+	es := New(nil, nil).(*eventSource)
+	defer es.Close()
+
+	recorder := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest("GET", "/", nil)
+	rc, err := newResponseConn(wrappedWriter{recorder}, req, es, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	deadline := time.Now().Add(time.Second)
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.deadlines) != 0 {
+		t.Errorf("expected the deadline set with the write, got %v", recorder.deadlines)
+	}
+
+	// the deadline is cleared after the write, so it doesn't expire while
+	// the stream is idle
+	if _, err := rc.Write([]byte("data: test\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.deadlines) != 2 || !recorder.deadlines[0].Equal(deadline) || !recorder.deadlines[1].IsZero() {
+		t.Errorf("expected the deadline set and cleared, got %v", recorder.deadlines)
+	}
+
+	// writers without deadlines are streamed to without them
+	rc, err = newResponseConn(httptest.NewRecorder(), req, es, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		t.Errorf("expected no error without deadline support, got %v", err)
+	}
+}
+
+func TestHTTP2IdleLongerThanTimeout(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Timeout = 200 * time.Millisecond
+	es := New(settings, nil)
+	server := httptest.NewUnstartedServer(es)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	defer es.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for es.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the deadline of a write doesn't reset the stream once it's idle
+	for _, data := range []string{"before", "after"} {
+		es.SendEventMessage(data, "", "")
+		expected := "data: " + data + "\n\n"
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(resp.Body, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != expected {
+			t.Errorf("expected %q, got %q", expected, buf)
+		}
+		time.Sleep(3 * settings.Timeout)
+	}
+	if n := es.ConsumersCount(); n != 1 {
+		t.Errorf("expected the idle consumer to stay connected, got %d consumers", n)
+	}
+}
@@ -0,0 +1,140 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ConsumerInfo describes a connected consumer.
+type ConsumerInfo struct {
+	ID ConsumerID `json:"id"`
+
+	// RemoteAddr is the address of the client, UserAgent is its
+	// User-Agent header.
+	RemoteAddr string `json:"remote_addr"`
+	UserAgent  string `json:"user_agent,omitempty"`
+
+	// Header holds the request headers, nil for connections attached
+	// without a request. It isn't listed by DebugHandler, as it may
+	// carry credentials.
+	Header http.Header `json:"-"`
+
+	// Value is the value set by SetConsumerValue, or nil.
+	Value interface{} `json:"-"`
+
+	// Channels are the channels the consumer is subscribed to, Metadata
+	// is the metadata it's tagged with.
+	Channels []string          `json:"channels,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Queued is the number of messages waiting to be written to the
+	// consumer, Dropped is the number of messages dropped because its
+	// buffer was full.
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+
+	// ConnectedAt is when the consumer connected, LastActivity is when a
+	// message was last written to it.
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"`
+
+	// LastError is the last error encountered writing to the consumer or
+	// the reason it's being disconnected, e.g. ErrIdleTimeout, or nil.
+	LastError error `json:"-"`
+}
+
+// info returns the description of the consumer.
+func (c *consumer) info() ConsumerInfo {
+	info := ConsumerInfo{
+		ID:           c.id,
+		RemoteAddr:   c.remoteAddr,
+		UserAgent:    c.userAgent,
+		Header:       c.header.Clone(),
+		Channels:     c.channels,
+		Queued:       len(c.in) + len(c.priority),
+		Dropped:      atomic.LoadUint64(&c.drops),
+		ConnectedAt:  c.connectedAt,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&c.lastActivity)),
+		LastError:    c.lastError(),
+	}
+	if v, ok := c.value.Load().(consumerValue); ok {
+		info.Value = v.value
+	}
+	if c.metadata != nil {
+		info.Metadata = make(map[string]string, len(c.metadata))
+		for key, value := range c.metadata {
+			info.Metadata[key] = value
+		}
+	}
+	return info
+}
+
+// consumerValue wraps the values of consumers, so values of any type can
+// be stored in the same atomic.Value.
+type consumerValue struct {
+	value interface{}
+}
+
+// consumerInfos returns the descriptions of the connected consumers,
+// ordered by ID.
+func (es *eventSource) consumerInfos() []ConsumerInfo {
+	infos := make([]ConsumerInfo, 0, es.consumers.len())
+	es.consumers.each(func(c *consumer) {
+		if !c.isStaled() {
+			infos = append(infos, c.info())
+		}
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// debugConsumer is a consumer as rendered by the debug handler.
+type debugConsumer struct {
+	ConsumerInfo
+	Uptime    string `json:"uptime"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+var debugTemplate = template.Must(template.New("consumers").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Consumers</title></head>
+<body>
+<h1>{{len .}} consumers</h1>
+<table>
+<tr><th>ID</th><th>Remote address</th><th>User agent</th><th>Channels</th><th>Queued</th><th>Dropped</th><th>Uptime</th></tr>
+{{range .}}<tr><td>{{.ID}}</td><td>{{.RemoteAddr}}</td><td>{{.UserAgent}}</td><td>{{range $i, $c := .Channels}}{{if $i}}, {{end}}{{$c}}{{end}}</td><td>{{.Queued}}</td><td>{{.Dropped}}</td><td>{{.Uptime}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (es *eventSource) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		infos := es.consumerInfos()
+		consumers := make([]debugConsumer, len(infos))
+		for i, info := range infos {
+			uptime := now.Sub(info.ConnectedAt).Round(time.Second)
+			consumers[i] = debugConsumer{ConsumerInfo: info, Uptime: uptime.String()}
+			if info.LastError != nil {
+				consumers[i].LastError = info.LastError.Error()
+			}
+		}
+
+		resp.Header().Set("Cache-Control", "no-store")
+		if req.URL.Query().Get("format") == "html" || strings.Contains(req.Header.Get("Accept"), "text/html") {
+			resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+			debugTemplate.Execute(resp, consumers)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(consumers)
+	})
+}
@@ -0,0 +1,39 @@
+package eventsource
+
+import (
+	"crypto/sha256"
+	"time"
+)
+
+// duplicateFilter drops events with the same type and data as the event
+// broadcast right before them. It's used by the control goroutine only.
+type duplicateFilter struct {
+	maxSuppression time.Duration
+
+	// event and hash are the type and the data hash of the last event
+	// broadcast, sent is when it has been broadcast or zero if none has
+	event string
+	hash  [sha256.Size]byte
+	sent  time.Time
+}
+
+func newDuplicateFilter(maxSuppression time.Duration) *duplicateFilter {
+	return &duplicateFilter{maxSuppression: maxSuppression}
+}
+
+// duplicate reports whether m is an event to drop, it records it as the
+// last event otherwise. An event isn't dropped once maxSuppression, if
+// positive, has passed since the last event was sent.
+func (f *duplicateFilter) duplicate(m message, now time.Time) bool {
+	em, ok := m.(*eventMessage)
+	if !ok {
+		return false
+	}
+	hash := sha256.Sum256([]byte(em.data))
+	if !f.sent.IsZero() && f.event == em.event && f.hash == hash &&
+		(f.maxSuppression <= 0 || now.Sub(f.sent) < f.maxSuppression) {
+		return true
+	}
+	f.event, f.hash, f.sent = em.event, hash, now
+	return false
+}
@@ -6,7 +6,7 @@ Example:
         package main
 
         import (
-            "gopkg.in/antage/eventsource.v1"
+            "github.com/antage/eventsource/v2"
             "log"
             "net/http"
             "strconv"
@@ -0,0 +1,77 @@
+package eventsource
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// framePool holds the buffers messages are encoded into before being
+// copied to exactly sized frames, which are retained by consumer buffers.
+var framePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// frame encodes m terminated with the blank line dispatching the event,
+// followed by the configured extra blank lines.
+func (es *eventSource) frame(m message) []byte {
+	buf := framePool.Get().(*[]byte)
+	b := m.appendMessage((*buf)[:0])
+	b = append(b, es.terminator...)
+
+	frame := make([]byte, len(b))
+	copy(frame, b)
+
+	// huge buffers aren't kept around after a burst of large messages
+	if cap(b) <= 64<<10 {
+		*buf = b
+		framePool.Put(buf)
+	}
+	return frame
+}
+
+// appendField appends a single line field, dropping line breaks which
+// SSE parsers would end the line at.
+func appendField(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	b = append(b, ": "...)
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c != '\r' && c != '\n' {
+			b = append(b, c)
+		}
+	}
+	return append(b, '\n')
+}
+
+// appendLines appends a field for every line of value, splitting it at
+// every CRLF, CR and LF, as SSE parsers do. A comment has an empty name.
+func appendLines(b []byte, name, value string) []byte {
+	for {
+		i := strings.IndexAny(value, "\r\n")
+		b = append(b, name...)
+		b = append(b, ": "...)
+		if i < 0 {
+			b = append(b, value...)
+			return append(b, '\n')
+		}
+		b = append(b, value[:i]...)
+		b = append(b, '\n')
+		if value[i] == '\r' && i+1 < len(value) && value[i+1] == '\n' {
+			i++
+		}
+		value = value[i+1:]
+	}
+}
+
+// appendRetry appends the retry field, rounding half up to whole
+// milliseconds.
+func appendRetry(b []byte, retry time.Duration) []byte {
+	ms := (retry + time.Millisecond/2) / time.Millisecond
+	b = append(b, "retry: "...)
+	b = strconv.AppendInt(b, int64(ms), 10)
+	return append(b, '\n')
+}
@@ -0,0 +1,50 @@
+package eventsource
+
+import "time"
+
+// Event is an event as sent with Send, passed to consumer filters and
+// stored by an EventStore. New fields may be added, so it should be
+// created with field names.
+type Event struct {
+	ID   string
+	Type string
+	Data string
+
+	// Retry is sent as the reconnection delay within the event frame if
+	// positive, clamped like SendRetryMessage durations. It isn't passed
+	// to filters or stored.
+	Retry time.Duration
+
+	// Comment is written as comment lines before the event fields, it
+	// isn't passed to filters or stored
+	Comment string
+
+	// TTL overrides Settings.MessageTTL if positive, it isn't passed to
+	// filters or stored
+	TTL time.Duration
+}
+
+// BroadcastInfo describes a message sent to all consumers, see
+// Settings.OnBroadcast.
+type BroadcastInfo struct {
+	// Event and ID are the event type and id of an event, they're empty
+	// for other messages, such as retry messages and comments.
+	Event string
+	ID    string
+
+	// Consumers is the number of connected consumers.
+	Consumers int
+
+	// Delivered and Dropped are the numbers of consumers the message has
+	// been queued for and of consumers which dropped it because their
+	// buffers were full.
+	Delivered int
+	Dropped   int
+
+	// Bytes is the total size of the frames queued for consumers.
+	Bytes int
+
+	// Start is when the event has been sent with
+	// SendEventMessageContext, or when broadcasting the message started.
+	Start time.Time
+}
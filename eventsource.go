@@ -2,12 +2,19 @@ package eventsource
 
 import (
 	"bytes"
-	"container/list"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,32 +22,304 @@ type eventMessage struct {
 	id    string
 	event string
 	data  string
+
+	// alwaysData forces a data field even if data is empty
+	alwaysData bool
+
+	// dataField is the name of data fields, "data" if empty
+	dataField string
+
+	// comment is written before the fields
+	comment string
+
+	// retry is sent along with the event if positive
+	retry time.Duration
+
+	// ttl is how long the event may wait in consumer buffers if positive
+	ttl time.Duration
+
+	// priority events are queued like control messages, see isPriority
+	priority bool
+
+	// ctx is the context the event has been sent with, sent is when, they
+	// are reported to the OnBroadcast hook
+	ctx  context.Context
+	sent time.Time
+}
+
+// variantMessage is an event with data variants for consumers with
+// different capabilities.
+type variantMessage struct {
+	// variants by capability
+	variants map[string]*eventMessage
+}
+
+// batchMessage is a sequence of events written to consumers at once.
+type batchMessage struct {
+	events []*eventMessage
+
+	// terminator ends every event but the last one, which is terminated
+	// like any message
+	terminator []byte
+
+	// ttl is the shortest positive TTL of the events
+	ttl time.Duration
+}
+
+type commentMessage struct {
+	comment string
+
+	// priority comments are queued like control messages, see isPriority
+	priority bool
+}
+
+// targetedMessage is a message sent to a single consumer.
+type targetedMessage struct {
+	message
+
+	// target returns the recipient or nil if there is none, it's called
+	// by the control goroutine
+	target func() *consumer
+
+	// closeErr closes the recipient with the error recorded as its last
+	// error once the message, which may be nil, has been queued, unless
+	// it's nil
+	closeErr error
+
+	// result receives ErrConsumerNotFound if there is no recipient
+	result chan error
+}
+
+// filterMessage replaces the event filter of a consumer, then sends the
+// consumer the embedded filter-changed notification if there is one.
+type filterMessage struct {
+	message
+
+	id     ConsumerID
+	filter func(e Event) bool
+
+	// result receives ErrConsumerNotFound if there is no such consumer
+	result chan error
+}
+
+// valueMessage sets the application value of a consumer, it's passed
+// through the control goroutine so consumers added by OnConnect are found.
+type valueMessage struct {
+	id    ConsumerID
+	value interface{}
+
+	// result receives ErrConsumerNotFound if there is no such consumer
+	result chan error
+}
+
+// appendMessage appends nothing, the message isn't sent to clients.
+func (vm *valueMessage) appendMessage(b []byte) []byte {
+	return b
 }
 
 type retryMessage struct {
 	retry time.Duration
 }
 
+// countedMessage is a broadcast message reporting how many consumers it
+// has been queued for.
+type countedMessage struct {
+	message
+
+	result chan deliveryCount
+}
+
+type deliveryCount struct {
+	delivered int
+	dropped   int
+
+	// bytes is the total size of the queued frames
+	bytes int
+}
+
+func (dc *deliveryCount) add(count deliveryCount) {
+	dc.delivered += count.delivered
+	dc.dropped += count.dropped
+	dc.bytes += count.bytes
+}
+
+// channelMessage is a message sent to consumers subscribed to the channel.
+type channelMessage struct {
+	message
+
+	channel string
+}
+
+// matchMessage is a message sent to consumers with all the matching
+// metadata.
+type matchMessage struct {
+	message
+
+	match map[string]string
+}
+
+// ErrSendTimeout is returned when a message can't be queued for sending in
+// time.
+var ErrSendTimeout = errors.New("eventsource: send timeout")
+
+// ErrCloseTimeout is returned when closing an EventSource doesn't finish in
+// time.
+var ErrCloseTimeout = errors.New("eventsource: close timeout")
+
+// ErrConsumerNotFound is returned when there is no connected consumer with
+// the given ID.
+var ErrConsumerNotFound = errors.New("eventsource: consumer not found")
+
+// ErrInvalidBufferSize is returned when a consumer buffer size isn't
+// positive.
+var ErrInvalidBufferSize = errors.New("eventsource: buffer size must be positive")
+
+// ErrIdleTimeout is recorded as the last error of a consumer closed after
+// being idle for too long, by IdleTimeout or PruneIdle.
+var ErrIdleTimeout = errors.New("eventsource: idle timeout")
+
+// ErrConsumerClosed is recorded as the last error of a consumer closed by
+// CloseConsumer.
+var ErrConsumerClosed = errors.New("eventsource: consumer closed")
+
+// ErrConnectionLimit is recorded as the last error of a consumer closed
+// for a newer connection with the same key, see
+// Settings.EvictOldestConnection.
+var ErrConnectionLimit = errors.New("eventsource: connection limit reached")
+
+// ErrGoroutineLimit is returned when a consumer can't be attached because
+// the consumer goroutine limit has been reached.
+var ErrGoroutineLimit = errors.New("eventsource: consumer goroutine limit reached")
+
+// ErrClientClosed is recorded as the last error of a consumer closed
+// because the client closed its connection.
+var ErrClientClosed = errors.New("eventsource: client closed connection")
+
+// ErrClosed is returned when using an event source which has been closed.
+var ErrClosed = errors.New("eventsource: closed")
+
+// ErrInvalidID is returned in strict mode when an event id contains a line
+// break or NUL.
+var ErrInvalidID = errors.New("eventsource: invalid event id")
+
+// ErrInvalidEventName is returned in strict mode when an event name
+// contains a line break or NUL.
+var ErrInvalidEventName = errors.New("eventsource: invalid event name")
+
+// ConsumerID identifies a consumer connection within an EventSource.
+type ConsumerID uint64
+
 type eventSource struct {
+	// lastConsumerID is the last assigned consumer ID, accessed atomically
+	lastConsumerID uint64
+
+	// closing is set to 1 by Shutdown, accessed atomically
+	closing int32
+
+	// retired is set to 1 by Retire, accessed atomically, retiredMessage
+	// is stored after it and rejects new requests once stored
+	retired        int32
+	retiredMessage atomic.Value
+	retiredStatus  int
+	farewellEvent  string
+	shutdownEvent  string
+
+	stats stats
+
 	customHeadersFunc func(*http.Request) [][]byte
+	onConnect         func(*http.Request, ConsumerID)
+	onFrame           func(ConsumerID, int)
+	onDisconnect      func(ConsumerID, error)
+
+	sink               chan message
+	staled             chan *consumer
+	add                chan *consumer
+	resize             chan resizeRequest
+	close              chan bool
+	stopped            chan bool
+	finished           chan bool
+	idleTimeout        time.Duration
+	keepAliveInterval  time.Duration
+	retry              time.Duration
+	minRetry           time.Duration
+	timeout            time.Duration
+	closeOnTimeout     bool
+	encoders           []*encoder
+	alwaysEmitData     bool
+	filterChangedEvent string
+	watchClientClose   bool
+	streamingHeaders   bool
+	strict             bool
+	errorEvent         string
+	dataField          string
+	terminator         []byte
+	acceptLimiter      *tokenBucket
+	ipAcceptLimiter    *keyedLimiter
+	connectionKey      func(*http.Request) string
+	connectionCaps     *connectionCaps
+	serializers        map[string]Serializer
+	consumerMetadata   func(*http.Request) map[string]string
+	onConnectSend      func(*http.Request) []Event
+	onBroadcast        func(context.Context, BroadcastInfo)
+	onError            func(ConsumerID, error)
+	logger             Logger
+	consumerFilter     func(*http.Request, Event) bool
+	cors               *CORS
+	authorize          func(*http.Request) (int, error)
+	headersFunc        func(*http.Request) (int, http.Header)
+	reorder            *reorderBuffer
+	throttle           *throttle
+	store              EventStore
+
+	// sticky keeps the last event of every type if StickyEvents is set
+	sticky *stickyEvents
 
-	sink           chan message
-	staled         chan *consumer
-	add            chan *consumer
-	close          chan bool
-	idleTimeout    time.Duration
-	retry          time.Duration
-	timeout        time.Duration
-	closeOnTimeout bool
-	gzip           bool
+	// autoIDs enables numbering events without an id, lastSequence is the
+	// last number, it's used by the goroutine sending broadcasts only
+	autoIDs      bool
+	lastSequence uint64
 
-	consumersLock sync.RWMutex
-	consumers     *list.List
+	// lastEventID is the id of the last broadcast event
+	lastEventID atomic.Value
+
+	// suppressDuplicates enables skipping a broadcast frame identical to
+	// lastFrameHash, the hash of the previous one
+	suppressDuplicates bool
+	lastFrameHash      [sha256.Size]byte
+	duplicates         *duplicateFilter
+	maxGoroutines      int64
+	maxConsumers       int64
+	retryAfter         string
+
+	consumers *registry
+
+	// fanOut are the job channels of the fan-out workers, if any
+	fanOut []chan *fanOutJob
+
+	consumerBufferSize int
+	overflowPolicy     OverflowPolicy
+	overflowTimeout    time.Duration
+	slowConsumerDrops  int
+	slowConsumerLag    time.Duration
+	maxQueuedBytes     int64
+	maxBatchSize       int
+	flushInterval      time.Duration
+	messageTTL         time.Duration
+
+	// evicted are the consumers to be removed after dispatching a message
+	evictedLock sync.Mutex
+	evicted     []*consumer
+
+	// closedConsumers are the consumers closed by the control goroutine,
+	// set before finished is closed
+	closedConsumers []*consumer
 }
 
 type Settings struct {
-	// SetTimeout sets the write timeout for individual messages. The
-	// default is 2 seconds.
+	// SetTimeout sets the write timeout for individual messages. Streams
+	// written through a ResponseWriter which can't be hijacked only time
+	// out when built with Go 1.20 or later and the ResponseWriter supports
+	// write deadlines. The default is 2 seconds.
 	Timeout time.Duration
 
 	// CloseOnTimeout sets whether a write timeout should close the
@@ -58,18 +337,511 @@ type Settings struct {
 	IdleTimeout time.Duration
 
 	// Gzip sets whether to use gzip Content-Encoding for clients which
-	// support it.
+	// support it. Compressors are reused across connections.
 	//
 	// The default is false.
 	Gzip bool
+
+	// GzipLevel sets the gzip compression level, from gzip.HuffmanOnly to
+	// gzip.BestCompression. Zero and invalid levels mean
+	// gzip.DefaultCompression.
+	//
+	// The default is gzip.DefaultCompression.
+	GzipLevel int
+
+	// Encodings are the content codings streams are compressed with
+	// besides gzip, e.g. brotli or zstd ones wrapping third-party
+	// packages, in preference order. Every client gets the first one its
+	// Accept-Encoding header accepts, gzip comes last if it's enabled.
+	//
+	// The default is nil.
+	Encodings []Encoding
+
+	// MinRetry sets the smallest reconnection delay sent in retry
+	// messages. Shorter durations, including zero and negative ones, are
+	// raised to it. Values below 1 millisecond are treated as 1
+	// millisecond, so clients are never told to reconnect instantly.
+	//
+	// The default is 1 millisecond.
+	MinRetry time.Duration
+
+	// AlwaysEmitData sets whether every event includes at least one data
+	// field. Without a data field (an event with only an id or an event
+	// type) browsers update the last event id but don't dispatch an event,
+	// and some strict parsers mishandle such frames. When enabled an empty
+	// "data: " line is written, so every event is dispatched with empty
+	// data.
+	//
+	// The default is false.
+	AlwaysEmitData bool
+
+	// ConsumerBufferSize sets how many messages may be queued for every
+	// consumer, see ResizeConsumerBuffer for changing it later.
+	//
+	// The default is 10.
+	ConsumerBufferSize int
+
+	// OverflowPolicy sets what happens to a message for a consumer whose
+	// buffer is full.
+	//
+	// The default is DropNewest.
+	OverflowPolicy OverflowPolicy
+
+	// OverflowTimeout sets how long the Block overflow policy waits for
+	// room in a consumer buffer.
+	//
+	// The default is 1 second.
+	OverflowTimeout time.Duration
+
+	// MaxBatchSize sets up to how many bytes of queued messages are
+	// coalesced into a single write to a consumer connection, saving
+	// syscalls when messages come faster than they're written. Messages
+	// aren't split, so a write may exceed it by one message.
+	//
+	// The default is 0, every message is written on its own.
+	MaxBatchSize int
+
+	// FlushInterval sets how long a consumer waits for more messages to
+	// fill a batch (see MaxBatchSize) before writing it, delaying messages
+	// by up to it.
+	//
+	// The default is 0, only messages already queued are coalesced.
+	FlushInterval time.Duration
+
+	// MessageTTL sets how long an event may wait in a consumer buffer, an
+	// event still queued when it expires is skipped rather than written
+	// late, e.g. a stale price after a stall. Event.TTL overrides it for
+	// single events. Stats.Expired counts skipped events.
+	//
+	// The default is 0, events don't expire.
+	MessageTTL time.Duration
+
+	// MaxQueuedBytes caps the total size of messages queued for all
+	// consumers, so a network outage doesn't make memory usage grow with
+	// the number of consumers. Over the cap a message for a consumer with
+	// queued messages is handled as if its buffer was full by the
+	// OverflowPolicy, except Block drops it right away. Consumers keeping
+	// up, with nothing queued, get messages regardless, so the slowest
+	// ones are shed. Stats.QueuedBytes reports the total size.
+	//
+	// The default is 0, there's no cap.
+	MaxQueuedBytes int64
+
+	// SlowConsumerDrops sets after how many messages dropped in a row
+	// (see OverflowPolicy) a consumer is disconnected as too slow,
+	// recording ErrSlowConsumer as its last error. A client which stopped
+	// reading is cut off rather than silently missing events forever.
+	//
+	// The default is 0, consumers aren't disconnected for dropping
+	// messages.
+	SlowConsumerDrops int
+
+	// SlowConsumerLag sets how long a consumer may go without finishing a
+	// write while messages are queued for it, it's disconnected as too
+	// slow with ErrSlowConsumer when the next message comes then.
+	//
+	// The default is 0, consumers aren't disconnected for lagging.
+	SlowConsumerLag time.Duration
+
+	// FanOutWorkers sets how many goroutines deliver every broadcast, each
+	// to its own partition of the consumers, so consumers with full
+	// buffers or expensive filters delay fewer others. Filters and
+	// serializers are called concurrently then. It's capped at 32, with 0
+	// or 1 the control goroutine delivers broadcasts itself. Stats.FanOut
+	// counts deliveries by worker.
+	//
+	// The default is 0.
+	FanOutWorkers int
+
+	// AddBufferSize sets how many new consumers may wait to be registered
+	// by the control goroutine without blocking their ServeHTTP calls.
+	// A larger buffer keeps connection setup fast during reconnect storms.
+	//
+	// The default is 64.
+	AddBufferSize int
+
+	// ExtraBlankLines sets how many blank lines are written after the one
+	// terminating every message, for intermediaries which need padding
+	// between events.
+	//
+	// The default is 0.
+	ExtraBlankLines int
+
+	// MaxAcceptRate limits how many new connections per second are
+	// accepted. Connections over the limit are rejected with 429 Too Many
+	// Requests and a Retry-After header, the time until a connection is
+	// accepted again but at least MinRetry. Zero means no limit.
+	//
+	// The default is 0.
+	MaxAcceptRate float64
+
+	// AcceptBurst sets how many connections may be accepted at once
+	// regardless of MaxAcceptRate.
+	//
+	// The default is 1.
+	AcceptBurst int
+
+	// MaxAcceptRatePerIP limits how many new connections per second are
+	// accepted from every client IP address, taken from the remote
+	// address of requests, like MaxAcceptRate. Zero means no limit.
+	//
+	// The default is 0.
+	MaxAcceptRatePerIP float64
+
+	// AcceptBurstPerIP sets how many connections may be accepted at once
+	// from a client IP address regardless of MaxAcceptRatePerIP.
+	//
+	// The default is 1.
+	AcceptBurstPerIP int
+
+	// MaxGoroutines limits the number of consumer goroutines. New
+	// connections over the limit are rejected with 503 Service
+	// Unavailable. Zero means no limit.
+	//
+	// The default is 0.
+	MaxGoroutines int
+
+	// MaxConsumers limits the number of connected consumers, including
+	// the ones attached with AttachConn. New requests over the limit are
+	// rejected with 503 Service Unavailable and a Retry-After header of
+	// MaxConsumersRetryAfter, instead of exhausting file descriptors.
+	// Zero means no limit.
+	//
+	// The default is 0.
+	MaxConsumers int
+
+	// MaxConsumersRetryAfter sets the Retry-After header of requests
+	// rejected by MaxConsumers, it's rounded up to seconds.
+	//
+	// The default is 5 seconds.
+	MaxConsumersRetryAfter time.Duration
+
+	// ConnectionKey returns the key connections are counted by for
+	// MaxConnectionsPerKey, e.g. the client IP address or the user
+	// authenticated by the request. Requests with an empty key aren't
+	// counted.
+	//
+	// The default is nil.
+	ConnectionKey func(req *http.Request) string
+
+	// MaxConnectionsPerKey limits the number of consumers connected with
+	// the same ConnectionKey, e.g. against clients opening a stream in
+	// every tab. New requests over the limit are rejected with 429 Too
+	// Many Requests, unless EvictOldestConnection is set. Zero means no
+	// limit.
+	//
+	// The default is 0.
+	MaxConnectionsPerKey int
+
+	// EvictOldestConnection sets whether a new request over
+	// MaxConnectionsPerKey closes the oldest consumer with the same key,
+	// recording ErrConnectionLimit as its last error, instead of being
+	// rejected.
+	//
+	// The default is false.
+	EvictOldestConnection bool
+
+	// DataFieldName sets the name of the field carrying event data. It
+	// must not contain colons or line breaks.
+	//
+	// Browser EventSource clients only read the "data" field and ignore
+	// any other, so changing it breaks compatibility with them. It's meant
+	// for custom clients reusing the event stream framing.
+	//
+	// The default is "data".
+	DataFieldName string
+
+	// SuppressDuplicateFrames sets whether a broadcast frame identical to
+	// the previous one is dropped instead of being sent again. Comments,
+	// such as heartbeats, are always sent.
+	//
+	// The default is false.
+	SuppressDuplicateFrames bool
+
+	// SuppressDuplicateEvents sets whether a broadcast event with the same
+	// type and data as the event broadcast right before it is dropped,
+	// whatever their ids, e.g. for loops publishing a state which rarely
+	// changes. Other messages don't separate duplicates. Dropped events
+	// don't take an id with AutoIDs.
+	//
+	// The default is false.
+	SuppressDuplicateEvents bool
+
+	// MaxDuplicateSuppression sets how long duplicates are dropped by
+	// SuppressDuplicateEvents after the event was last sent, so the state
+	// is still sent periodically. Zero means
+	// duplicates are always dropped.
+	//
+	// The default is 0.
+	MaxDuplicateSuppression time.Duration
+
+	// WatchClientClose sets whether every connection is read from, so a
+	// client closing its connection is noticed and the consumer is removed
+	// right away instead of on the next failed write or the idle timeout.
+	// Anything the client sends is discarded. It takes an additional
+	// goroutine per connection. Connections which can't be hijacked (e.g.
+	// HTTP/2) are watched through the request context regardless.
+	//
+	// The default is true.
+	WatchClientClose bool
+
+	// Strict sets whether sending an event with an id or name containing a
+	// line break or NUL fails with ErrInvalidID or ErrInvalidEventName.
+	// Otherwise line breaks are removed, and browsers ignore ids with NUL.
+	//
+	// The default is false.
+	Strict bool
+
+	// StreamingHeaders sets whether "Cache-Control: no-cache" and
+	// "X-Accel-Buffering: no" are sent, so caches and proxies like nginx
+	// don't hold back events. The ones set by Settings.Headers take
+	// precedence. "Connection: keep-alive" isn't sent, hijacked responses
+	// are delimited by closing the connection and HTTP/2 forbids it.
+	//
+	// The default is true.
+	StreamingHeaders bool
+
+	// FilterChangedEvent sets the event type of the event sent to a
+	// consumer when its filter is replaced with SetConsumerFilter. Events
+	// broadcast before it were filtered by the old filter and events
+	// broadcast after it are filtered by the new one. No event is sent if
+	// it's empty.
+	//
+	// The default is "".
+	FilterChangedEvent string
+
+	// ErrorEvent sets the event type of the error event sent by
+	// CloseWithError.
+	//
+	// The default is "error".
+	ErrorEvent string
+
+	// RetiredStatus sets the status of responses to requests coming after
+	// Retire.
+	//
+	// The default is 410 (Gone).
+	RetiredStatus int
+
+	// FarewellEvent sets the event type of the event sent to consumers by
+	// Retire.
+	//
+	// The default is "farewell".
+	FarewellEvent string
+
+	// ShutdownEvent sets the event type of the event sent to all consumers
+	// by Shutdown. No event is sent if it's empty. Unlike ErrorEvent and
+	// FarewellEvent events it follows queued messages, which Shutdown
+	// writes before closing consumers.
+	//
+	// The default is "".
+	ShutdownEvent string
+
+	// ReorderWindow sets how long events with numeric ids are held to be
+	// released in id order, so clients relying on monotonic ids aren't
+	// confused by producers racing each other. An event is released as
+	// soon as all lower ids have been, otherwise once it has been held for
+	// the window, preceded by a ReorderGapEvent event with the missing ids
+	// (e.g. "5" or "5-7") as data. Events delivered late get up to the
+	// window of latency. Events arriving after their successor has been
+	// released, events without numeric ids and other messages aren't
+	// held.
+	//
+	// The default is 0, events aren't reordered.
+	ReorderWindow time.Duration
+
+	// ReorderGapEvent sets the event type of the event marking ids which
+	// didn't arrive within the ReorderWindow.
+	//
+	// The default is "gap".
+	ReorderGapEvent string
+
+	// Throttle maps event types ("" for events without a type) to windows
+	// events of the type are coalesced within, e.g. for tickers published
+	// faster than clients need. The first event of a type is broadcast
+	// right away, then the latest one received within the window is
+	// broadcast once it ends, starting the next window. Events replaced
+	// meanwhile are never sent nor kept for replay. Only events broadcast
+	// to all consumers are throttled.
+	//
+	// The default is nil.
+	Throttle map[string]time.Duration
+
+	// HistorySize sets how many of the most recently broadcast events are
+	// kept for replay. A consumer connecting with a Last-Event-ID header
+	// gets the kept events following that id before any new ones. Nothing
+	// is replayed if the id isn't kept anymore.
+	//
+	// The default is 0, events aren't kept.
+	HistorySize int
+
+	// EventStore replaces the in-memory history of HistorySize events,
+	// e.g. with a durable one so consumers don't miss events after a
+	// restart.
+	//
+	// The default is nil.
+	EventStore EventStore
+
+	// StickyEvents sets whether the last broadcast event of every event
+	// type is kept and sent to new consumers before any new events, so
+	// they get the current state on connect. Consumers reconnecting with a
+	// Last-Event-ID header get the events they missed from the EventStore
+	// (see HistorySize) instead, if there is one.
+	// Events sent to channels, matching metadata or single consumers and
+	// variants aren't kept.
+	//
+	// The default is false.
+	StickyEvents bool
+
+	// AutoIDs sets whether broadcast events without an id get sequential
+	// ids, "1", "2" and so on, in the order they're sent to consumers, so
+	// clients can detect gaps and resume with Last-Event-ID. Numbering
+	// continues after the last id of an EventStore implementing
+	// LastEventIDStore, it starts over with every EventSource otherwise,
+	// so a durable EventStore should implement it. Events sent to channels, to
+	// consumers matching metadata or to single consumers don't get ids,
+	// other consumers would see gaps.
+	//
+	// The default is false.
+	AutoIDs bool
+
+	// CORS sets the cross-origin resource sharing headers sent with
+	// streams and preflight responses.
+	//
+	// The default is nil, no CORS headers are sent besides the custom
+	// ones.
+	CORS *CORS
+
+	// Authorize is called for every request before the connection is
+	// hijacked. A non-nil error rejects the request with the returned
+	// status code, 403 Forbidden if it's zero, e.g. 401 Unauthorized after
+	// failed token validation. CORS preflight requests aren't authorized,
+	// browsers send them without credentials.
+	//
+	// The default is nil, all requests are accepted.
+	Authorize func(req *http.Request) (int, error)
+
+	// Headers returns the status code and extra headers of the response
+	// to req, like the custom headers function given to New but with
+	// canonicalized header names. A zero status stands for 200 OK, any
+	// other status answers the request without streaming, e.g. 204 No
+	// Content stops browsers reconnecting. req is nil for AttachConn
+	// calls without a request.
+	//
+	// The default is nil.
+	Headers func(req *http.Request) (int, http.Header)
+
+	// ConsumerFilter selects the events sent to consumers connected with
+	// the request, e.g. by a tenant ID parsed from it. It's called from
+	// the control goroutine (or the fan-out workers) for every event and
+	// consumer, so it should be fast. SetConsumerFilter replaces it for a
+	// consumer.
+	//
+	// The default is nil, all events are sent.
+	ConsumerFilter func(req *http.Request, e Event) bool
+
+	// ConsumerMetadata returns the metadata consumers connected with the
+	// request are tagged with, e.g. a subscription tier, for sending
+	// messages to a subset of consumers.
+	//
+	// The default is nil, consumers have no metadata.
+	ConsumerMetadata func(req *http.Request) map[string]string
+
+	// OnConnectSend returns events sent to the consumer connected with the
+	// request before any others, e.g. a welcome message or a snapshot of
+	// the current state, with no broadcast coming in between. It's called
+	// from the ServeHTTP goroutine, consumer filters don't apply to the
+	// events. Events which are invalid in strict mode are skipped.
+	//
+	// If the last event has an id and there is an EventStore, events
+	// broadcast after the one with that id are replayed to consumers
+	// without a Last-Event-ID header, so broadcasts racing the snapshot
+	// aren't missed nor duplicated, provided the id is of a broadcast
+	// event.
+	//
+	// The default is nil.
+	OnConnectSend func(req *http.Request) []Event
+
+	// KeepAliveInterval sets how long a consumer may go without a write
+	// before a ": keepalive" comment is written to it, so proxies don't
+	// drop the idle connection. Keepalive comments don't reset
+	// IdleTimeout. A consumer failing a keepalive write is closed.
+	//
+	// The default is 0, no keepalive comments are written.
+	KeepAliveInterval time.Duration
+
+	// Serializers maps content types to serializers of formats served
+	// besides SSE. Each consumer gets the format preferred by the Accept
+	// header of its request, SSE if none of them is acceptable.
+	//
+	// The default is nil.
+	Serializers map[string]Serializer
+
+	// OnConnect is called when a consumer is connected, after the response
+	// headers have been written. Messages sent to the consumer from the
+	// hook, e.g. an initial snapshot with SendEventMessageTo, are
+	// delivered before any sent after it returns.
+	OnConnect func(req *http.Request, id ConsumerID)
+
+	// OnFrame is called from the consumer goroutine after a frame of size
+	// bytes has been written to the consumer. It shouldn't block.
+	OnFrame func(id ConsumerID, size int)
+
+	// OnDisconnect is called when the consumer connection is closed. It's
+	// called exactly once for every consumer passed to OnConnect, after
+	// OnConnect returns. err is
+	// the last error encountered writing to the consumer (e.g. a write
+	// timeout, a connection reset or ErrIdleTimeout), or nil if there was
+	// none.
+	OnDisconnect func(id ConsumerID, err error)
+
+	// OnBroadcast is called from the control goroutine after a message has
+	// been queued for all consumers, with the context it has been sent
+	// with by SendEventMessageContext, or context.Background(). It blocks
+	// broadcasting, so it shouldn't take long.
+	OnBroadcast func(ctx context.Context, info BroadcastInfo)
+
+	// OnError is called when writing to a consumer fails, including the
+	// response headers, when a consumer is closed after IdleTimeout and
+	// when it's disconnected by the overflow policy or as too slow (see
+	// ErrBufferOverflow and ErrSlowConsumer), e.g. to alert on elevated
+	// error rates. id is 0 if the connection couldn't be taken over for
+	// streaming. It's
+	// called from consumer goroutines or the control goroutine and
+	// shouldn't block.
+	OnError func(id ConsumerID, err error)
+
+	// Logger receives failures, such as connections which couldn't be set
+	// up, and routine events, such as disconnected consumers, dropped
+	// messages and closing. DiscardLogger silences it.
+	//
+	// The default prints failures with the log package and discards the
+	// rest.
+	Logger Logger
 }
 
+// maxRetry is the largest reconnection delay sent in retry messages.
+const maxRetry = 24 * time.Hour
+
 func DefaultSettings() *Settings {
 	return &Settings{
-		Timeout:        2 * time.Second,
-		CloseOnTimeout: true,
-		IdleTimeout:    30 * time.Minute,
-		Gzip:           false,
+		Timeout:                2 * time.Second,
+		CloseOnTimeout:         true,
+		IdleTimeout:            30 * time.Minute,
+		Gzip:                   false,
+		GzipLevel:              gzip.DefaultCompression,
+		MinRetry:               time.Millisecond,
+		AddBufferSize:          64,
+		AcceptBurst:            1,
+		ErrorEvent:             "error",
+		DataFieldName:          "data",
+		ReorderGapEvent:        "gap",
+		RetiredStatus:          http.StatusGone,
+		FarewellEvent:          "farewell",
+		WatchClientClose:       true,
+		StreamingHeaders:       true,
+		ConsumerBufferSize:     10,
+		OverflowTimeout:        time.Second,
+		MaxConsumersRetryAfter: 5 * time.Second,
 	}
 }
 
@@ -78,171 +850,1647 @@ type EventSource interface {
 	// it should implement ServerHTTP method
 	http.Handler
 
-	// send message to all consumers
-	SendEventMessage(data, event, id string)
+	// send event to all consumers, all send methods return ErrClosed
+	// once the EventSource has been closed
+	Send(e Event) error
+
+	// send message to all consumers, like Send
+	SendEventMessage(data, event, id string) error
+
+	// send events to all consumers in a single write each, so they're
+	// never interleaved with other messages nor dropped partially, a
+	// consumer gets the events its filter accepts
+	SendEvents(events []Event) error
+
+	// send v encoded as JSON to all consumers, the encoding error is
+	// returned if v can't be encoded
+	SendJSON(v interface{}, event, id string) error
+
+	// send message to all consumers and return how many consumers it has
+	// been queued for and how many dropped it because their buffers were
+	// full, the message isn't held by Settings.ReorderWindow
+	SendEventMessageCounted(data, event, id string) (delivered, dropped int, err error)
+
+	// send message to all consumers, giving up with ErrSendTimeout if the
+	// message can't be queued within timeout
+	SendEventMessageTimeout(data, event, id string, timeout time.Duration) error
+
+	// send message to all consumers only if it can be queued for sending
+	// without waiting, and report whether it has been
+	TrySendEventMessage(data, event, id string) bool
+
+	// send message to all consumers, giving up with the context error if
+	// ctx is done before the message is queued
+	SendEventMessageContext(ctx context.Context, data, event, id string) error
+
+	// send message to all consumers with data chosen by consumer
+	// capabilities: every consumer gets the variant for the first
+	// capability it advertised (in the "features" query parameter, comma
+	// separated) which has one, or the variant under the "" key otherwise
+	SendEventMessageVariants(variants map[string]string, event, id string) error
+
+	// send message to consumers subscribed to the channel, consumers
+	// subscribe to channels listed in the "channels" query parameter
+	// (comma separated)
+	SendEventMessageToChannel(data, event, id, channel string) error
+
+	// send message to the consumer with the id only, as given to
+	// Settings.OnConnect or returned by AttachConn, returns
+	// ErrConsumerNotFound if there is no such consumer
+	SendEventMessageTo(id ConsumerID, data, event, eventID string) error
+
+	// send message to the most recently connected consumer only, returns
+	// ErrConsumerNotFound if there are no consumers
+	SendEventMessageToLatest(data, event, id string) error
 
 	// send retry message to all consumers
-	SendRetryMessage(duration time.Duration)
+	SendRetryMessage(duration time.Duration) error
+
+	// send retry message to all consumers and return the counts like
+	// SendEventMessageCounted
+	SendRetryMessageCounted(duration time.Duration) (delivered, dropped int, err error)
+
+	// send retry message to consumers having all the metadata in match
+	SendRetryMessageWhere(match map[string]string, duration time.Duration) error
+
+	// send heartbeat comment to all consumers immediately, consumers which
+	// can't be written to are closed
+	Heartbeat() error
+
+	// send comment to all consumers, every line of text is prefixed with
+	// ": ", browsers ignore comments
+	SendComment(text string) error
+
+	// send comment to the consumer with the id only, like
+	// SendEventMessageTo
+	SendCommentTo(id ConsumerID, text string) error
+
+	// stream messages to an already established connection, which is
+	// handled like any consumer connected with ServeHTTP
+	AttachConn(conn net.Conn, options ...ConsumerOption) (ConsumerID, error)
+
+	// replace the event filter of the consumer, events for which the
+	// filter returns false aren't sent to it, nil filter lets all events
+	// through
+	SetConsumerFilter(id ConsumerID, filter func(event, id string) bool) error
+
+	// attach an application value to the consumer, e.g. the user it's
+	// authenticated as from Settings.OnConnect, it's reported in
+	// ConsumerInfo.Value
+	SetConsumerValue(id ConsumerID, value interface{}) error
 
 	// consumers count
 	ConsumersCount() int
 
-	// close and clear all consumers
+	// descriptions of the connected consumers ordered by id
+	Consumers() []ConsumerInfo
+
+	// handler listing the connected consumers for troubleshooting, as
+	// JSON, or as HTML for browsers or with the "format=html" query
+	// parameter, it shouldn't be exposed publicly
+	DebugHandler() http.Handler
+
+	// id of the last event broadcast, "" if none had an id, see
+	// Settings.AutoIDs
+	LastEventID() string
+
+	// statistics snapshot, write latencies cover the whole lifetime of
+	// the EventSource
+	Stats() Stats
+
+	// statistics snapshot clearing write latency observations, so the next
+	// one covers the time since, it's meant for a single reader and
+	// doesn't affect the snapshots taken by Stats
+	StatsAndReset() Stats
+
+	// replace the message buffer of the consumer with one of the given
+	// size, keeping queued messages which fit into it
+	ResizeConsumerBuffer(id ConsumerID, size int) error
+
+	// close consumers idle for longer than olderThan, recording
+	// ErrIdleTimeout as their last error, and return how many were closed
+	PruneIdle(olderThan time.Duration) int
+
+	// close the consumer with the id, sending it finalEvent first unless
+	// it's nil, e.g. to kick a session out
+	CloseConsumer(id ConsumerID, finalEvent *Event) error
+
+	// close and clear all consumers, it's safe to call more than once
 	Close()
+
+	// send error event with the reason to all consumers, then close and
+	// clear all consumers
+	CloseWithError(reason string)
+
+	// close and clear all consumers, giving up with ErrCloseTimeout and
+	// closing consumer connections directly if closing doesn't finish
+	// within timeout, which may take up to timeout once more
+	CloseWithTimeout(timeout time.Duration) error
+
+	// stop accepting consumers, send the ShutdownEvent, then close all
+	// consumers once they have written queued messages, giving up with
+	// the context error if ctx is done first
+	Shutdown(ctx context.Context) error
+
+	// sunset the endpoint: respond to new requests with the message and
+	// RetiredStatus, send farewell event with the message to all
+	// consumers, then close and clear all consumers
+	Retire(message string)
+}
+
+type resizeRequest struct {
+	id     ConsumerID
+	size   int
+	result chan error
+}
+
+// ConsumerOption configures a consumer attached with AttachConn.
+type ConsumerOption func(*consumerOptions)
+
+type consumerOptions struct {
+	writeHeaders bool
+	req          *http.Request
+	metadata     map[string]string
+}
+
+// WithMetadata tags the consumer attached with AttachConn with metadata,
+// replacing the one returned by Settings.ConsumerMetadata.
+func WithMetadata(metadata map[string]string) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.metadata = metadata
+	}
+}
+
+// WithResponseHeaders makes AttachConn write the HTTP response header
+// block, as ServeHTTP does, before streaming. req is used for the custom
+// headers function and gzip negotiation, it may be nil.
+func WithResponseHeaders(req *http.Request) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.writeHeaders = true
+		o.req = req
+	}
 }
 
 type message interface {
-	// The message to be sent to clients
-	prepareMessage() []byte
+	// Append the message fields to be sent to clients, without the
+	// terminating blank line, to b
+	appendMessage(b []byte) []byte
+}
+
+type consumerMessage interface {
+	message
+
+	// The message to be sent to the consumer c or nil to skip it
+	messageFor(c *consumer) message
 }
 
-func (m *eventMessage) prepareMessage() []byte {
-	var data bytes.Buffer
+func (m *eventMessage) appendMessage(b []byte) []byte {
+	if len(m.comment) > 0 {
+		b = appendLines(b, "", m.comment)
+	}
 	if len(m.id) > 0 {
-		data.WriteString(fmt.Sprintf("id: %s\n", strings.Replace(m.id, "\n", "", -1)))
+		b = appendField(b, "id", m.id)
 	}
 	if len(m.event) > 0 {
-		data.WriteString(fmt.Sprintf("event: %s\n", strings.Replace(m.event, "\n", "", -1)))
+		b = appendField(b, "event", m.event)
 	}
-	if len(m.data) > 0 {
-		lines := strings.Split(m.data, "\n")
-		for _, line := range lines {
-			data.WriteString(fmt.Sprintf("data: %s\n", line))
-		}
+	if m.retry > 0 {
+		b = appendRetry(b, m.retry)
 	}
-	data.WriteString("\n")
-	return data.Bytes()
+	if len(m.data) > 0 || m.alwaysData {
+		b = appendLines(b, m.dataFieldName(), m.data)
+	}
+	return b
 }
 
-func controlProcess(es *eventSource) {
-	for {
-		select {
-		case em := <-es.sink:
-			message := em.prepareMessage()
-			func() {
-				es.consumersLock.RLock()
-				defer es.consumersLock.RUnlock()
-
-				for e := es.consumers.Front(); e != nil; e = e.Next() {
-					c := e.Value.(*consumer)
-
-					// Only send this message if the consumer isn't staled
-					if !c.staled {
-						select {
-						case c.in <- message:
-						default:
-						}
-					}
-				}
-			}()
-		case <-es.close:
-			close(es.sink)
-			close(es.add)
-			close(es.staled)
-			close(es.close)
-
-			func() {
-				es.consumersLock.RLock()
-				defer es.consumersLock.RUnlock()
-
-				for e := es.consumers.Front(); e != nil; e = e.Next() {
-					c := e.Value.(*consumer)
-					close(c.in)
-				}
-			}()
+func (m *eventMessage) dataFieldName() string {
+	if m.dataField == "" {
+		return "data"
+	}
+	return m.dataField
+}
 
-			es.consumersLock.Lock()
-			defer es.consumersLock.Unlock()
+func (m *batchMessage) appendMessage(b []byte) []byte {
+	for i, em := range m.events {
+		if i > 0 {
+			b = append(b, m.terminator...)
+		}
+		b = em.appendMessage(b)
+	}
+	return b
+}
 
-			es.consumers.Init()
-			return
+func (m *variantMessage) appendMessage(b []byte) []byte {
+	if em, ok := m.variants[""]; ok {
+		return em.appendMessage(b)
+	}
+	return b
+}
+
+func (m *variantMessage) messageFor(c *consumer) message {
+	for _, capability := range c.capabilities {
+		if em, ok := m.variants[capability]; ok {
+			return em
+		}
+	}
+	if em, ok := m.variants[""]; ok {
+		return em
+	}
+	return nil
+}
+
+// frameKey identifies a frame of a message in a content type.
+type frameKey struct {
+	m           message
+	contentType string
+}
+
+// broadcast returns how many consumers the message has been queued for and
+// how many dropped it because their buffers were full.
+func (es *eventSource) broadcast(em message) (count deliveryCount) {
+	start := time.Now()
+	_, perConsumer := em.(consumerMessage)
+	if es.duplicates != nil && es.duplicates.duplicate(em, start) {
+		return count
+	}
+	frames := make(map[frameKey][]byte)
+	es.sequence(em)
+
+	if es.suppressDuplicates {
+		var hash [sha256.Size]byte
+		if !perConsumer {
+			frame := es.frame(em)
+			frames[frameKey{em, sseContentType}] = frame
+			hash = sha256.Sum256(frame)
+		}
+		_, comment := em.(*commentMessage)
+		if hash == es.lastFrameHash && !perConsumer && !comment {
+			return count
+		}
+		es.lastFrameHash = hash
+	}
+
+	switch m := em.(type) {
+	case *eventMessage:
+		es.keepEvent(m)
+	case *batchMessage:
+		for _, m := range m.events {
+			es.keepEvent(m)
+		}
+	}
+
+	if len(es.fanOut) > 0 {
+		count = es.fanOutBroadcast(em, frames)
+	} else {
+		for i := 0; i < registryShards; i++ {
+			count.add(es.deliver(em, i, frames))
+		}
+	}
+	if es.onBroadcast != nil {
+		es.reportBroadcast(em, count, start)
+	}
+	return count
+}
+
+// reportBroadcast calls the OnBroadcast hook. start is when broadcasting
+// the message started, it's reported for messages not knowing when they
+// have been sent.
+func (es *eventSource) reportBroadcast(em message, count deliveryCount, start time.Time) {
+	ctx := context.Background()
+	info := BroadcastInfo{
+		Consumers: es.consumers.len(),
+		Delivered: count.delivered,
+		Dropped:   count.dropped,
+		Bytes:     count.bytes,
+		Start:     start,
+	}
+	if m, ok := em.(*eventMessage); ok {
+		info.Event = m.event
+		info.ID = m.id
+		if m.ctx != nil {
+			ctx = m.ctx
+			info.Start = m.sent
+		}
+	}
+	es.onBroadcast(ctx, info)
+}
+
+// sequence numbers the events of a broadcast message without an id if
+// AutoIDs is set, and records the id of the last one.
+func (es *eventSource) sequence(em message) {
+	var events []*eventMessage
+	switch m := em.(type) {
+	case *eventMessage:
+		events = []*eventMessage{m}
+	case *batchMessage:
+		events = m.events
+	case *variantMessage:
+		// the variants are the same event
+		var id string
+		for _, v := range m.variants {
+			if v.id == "" && es.autoIDs {
+				if id == "" {
+					id = es.nextEventID()
+				}
+				v.id = id
+			}
+			id = v.id
+		}
+		if id != "" {
+			es.lastEventID.Store(id)
+		}
+		return
+	}
+	for _, m := range events {
+		if m.id == "" && es.autoIDs {
+			m.id = es.nextEventID()
+		}
+		if m.id != "" {
+			es.lastEventID.Store(m.id)
+		}
+	}
+}
+
+// seedSequence continues numbering events after the last id of the store.
+func (es *eventSource) seedSequence(store LastEventIDStore) {
+	id, err := store.LastEventID()
+	if err != nil {
+		es.logger.Error("Can't get the last stored event id", "error", err)
+		return
+	}
+	if id == "" {
+		return
+	}
+	sequence, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		es.logger.Error("Can't continue numbering after a non-numeric event id", "id", id)
+		return
+	}
+	es.lastSequence = sequence
+	es.lastEventID.Store(id)
+}
+
+func (es *eventSource) nextEventID() string {
+	es.lastSequence++
+	return strconv.FormatUint(es.lastSequence, 10)
+}
+
+// keepEvent appends a broadcast event to the event store and the sticky
+// events, if they're enabled.
+func (es *eventSource) keepEvent(m *eventMessage) {
+	if es.store != nil {
+		if err := es.store.Append(Event{ID: m.id, Type: m.event, Data: m.data}); err != nil {
+			es.logger.Error("Can't store an event", "id", m.id, "error", err)
+		}
+	}
+	if es.sticky != nil {
+		es.sticky.record(m)
+	}
+}
+
+// deliver queues the message for the consumers of the i-th registry shard,
+// caching its frames in frames.
+func (es *eventSource) deliver(em message, i int, frames map[frameKey][]byte) (count deliveryCount) {
+	cm, perConsumer := em.(consumerMessage)
+	es.consumers.eachInShard(i, func(c *consumer) {
+		// Only send this message if the consumer isn't staled
+		if c.isStaled() {
+			return
+		}
+		m := em
+		if perConsumer {
+			m = cm.messageFor(c)
+			if m == nil {
+				return
+			}
+		}
+		// a batch reduced for the consumer gets its own frame
+		if m = c.filtered(m); m == nil {
+			return
+		}
+		key := frameKey{m, c.contentType}
+		frame, ok := frames[key]
+		if !ok {
+			frame = es.serialize(c.serializer, m)
+			frames[key] = frame
+		}
+		if len(frame) == 0 {
+			return
+		}
+		if es.queue(c, m, frame) {
+			count.delivered++
+			count.bytes += len(frame)
+		} else {
+			count.dropped++
+		}
+	})
+	return count
+}
+
+func (es *eventSource) sendTargeted(tm *targetedMessage) {
+	c := tm.target()
+	if c == nil {
+		tm.result <- ErrConsumerNotFound
+		return
+	}
+	var err error
+	if tm.message != nil {
+		if frame := es.serialize(c.serializer, tm.message); len(frame) > 0 {
+			if !es.queue(c, tm.message, frame) && tm.closeErr != nil {
+				err = es.queueFinal(c, frame)
+			}
+		}
+	}
+	if tm.closeErr != nil && c.markStaled() {
+		c.setLastErr(tm.closeErr)
+		// the consumer goroutine exits once it has written the message
+		if es.consumers.remove(c) {
+			c.closeIn()
+		}
+	}
+	tm.result <- err
+}
+
+// queueFinal queues the final frame of a consumer being closed, which its
+// full buffer dropped, in the priority queue, so it's written ahead of the
+// queued messages rather than lost. It returns ErrBufferOverflow if the
+// frame can't be queued or the consumer has been evicted.
+func (es *eventSource) queueFinal(c *consumer, frame []byte) error {
+	if c.isStaled() {
+		return ErrBufferOverflow
+	}
+	select {
+	case c.priority <- queuedFrame{data: frame}:
+		es.stats.queued(len(frame))
+		return nil
+	default:
+		return ErrBufferOverflow
+	}
+}
+
+func (es *eventSource) setConsumerFilter(fm *filterMessage) {
+	c := es.consumer(fm.id)
+	if c == nil || c.isStaled() {
+		fm.result <- ErrConsumerNotFound
+		return
+	}
+
+	c.filter = fm.filter
+	if fm.message != nil {
+		if frame := es.serialize(c.serializer, fm.message); len(frame) > 0 {
+			es.queue(c, fm.message, frame)
+		}
+	}
+	fm.result <- nil
+}
+
+func (es *eventSource) setConsumerValue(vm *valueMessage) {
+	c := es.consumer(vm.id)
+	if c == nil || c.isStaled() {
+		vm.result <- ErrConsumerNotFound
+		return
+	}
+	c.value.Store(consumerValue{vm.value})
+	vm.result <- nil
+}
+
+// receive dispatches a message coming from the sink, passing it through
+// the reorder buffer if it's enabled.
+func (es *eventSource) receive(em message) {
+	if es.reorder != nil {
+		if id, ok := reorderID(em); ok {
+			for _, m := range es.reorder.push(em.(*eventMessage), id, time.Now()) {
+				es.dispatch(m)
+			}
+			return
+		}
+	}
+	es.dispatch(em)
+}
+
+// dispatch sends the message to its recipients.
+func (es *eventSource) dispatch(em message) {
+	switch m := em.(type) {
+	case *targetedMessage:
+		// the next broadcast isn't a duplicate for the target
+		es.lastFrameHash = [sha256.Size]byte{}
+		es.sendTargeted(m)
+	case *filterMessage:
+		es.lastFrameHash = [sha256.Size]byte{}
+		es.setConsumerFilter(m)
+	case *valueMessage:
+		es.setConsumerValue(m)
+	case *countedMessage:
+		m.result <- es.broadcast(m.message)
+	default:
+		if es.throttle != nil && es.throttle.hold(em, time.Now()) {
+			return
+		}
+		es.broadcast(em)
+	}
+	es.removeEvicted()
+}
+
+// release broadcasts the messages released by the throttle.
+func (es *eventSource) release(messages []message) {
+	for _, em := range messages {
+		es.broadcast(em)
+		es.removeEvicted()
+	}
+}
+
+func (es *eventSource) addConsumer(c *consumer) {
+	es.consumers.add(c)
+	es.replay(c)
+	es.removeEvicted()
+}
+
+// replay queues the OnConnectSend events of the consumer, then the stored
+// events it missed or the sticky events for a consumer without any,
+// growing its buffer to fit them all. It's called by the control goroutine
+// when the consumer is added, so the replayed events are the ones
+// broadcast before, and every later broadcast follows them.
+func (es *eventSource) replay(c *consumer) {
+	var frames [][]byte
+	var ttls []time.Duration
+	for _, m := range c.initial {
+		if frame := es.serialize(c.serializer, m); len(frame) > 0 {
+			frames = append(frames, frame)
+			ttls = append(ttls, m.ttl)
+		}
+	}
+	c.initial = nil
+
+	var messages []*eventMessage
+	if es.store != nil && c.lastEventID != "" {
+		events, err := es.store.After(c.lastEventID)
+		if err != nil {
+			es.logger.Error("Can't replay events", "consumer", c.id, "last_event_id", c.lastEventID, "error", err)
+		}
+		for _, e := range events {
+			messages = append(messages, es.newEventMessage(e.Data, e.Type, e.ID))
+		}
+	} else if es.sticky != nil {
+		messages = es.sticky.events()
+	}
+
+	for _, m := range messages {
+		if !c.accepts(m) {
+			continue
+		}
+		if frame := es.serialize(c.serializer, m); len(frame) > 0 {
+			frames = append(frames, frame)
+			ttls = append(ttls, m.ttl)
+		}
+	}
+	if free := cap(c.in) - len(c.in); len(frames) > free {
+		if es.resizeBuffer(c, cap(c.in)+len(frames)-free) != nil {
+			return
+		}
+	}
+	for i, frame := range frames {
+		// the buffer has room for all frames, they aren't subject to the
+		// overflow policy or MaxQueuedBytes so there are no gaps
+		c.in <- newQueuedFrame(frame, ttls[i])
+		es.stats.queued(len(frame))
+	}
+}
+
+// addPending adds the consumers waiting in the add channel.
+func (es *eventSource) addPending() {
+	for {
+		select {
 		case c := <-es.add:
-			func() {
-				es.consumersLock.Lock()
-				defer es.consumersLock.Unlock()
+			es.addConsumer(c)
+		default:
+			return
+		}
+	}
+}
 
-				es.consumers.PushBack(c)
-			}()
-		case c := <-es.staled:
-			toRemoveEls := make([]*list.Element, 0, 1)
-			func() {
-				es.consumersLock.RLock()
-				defer es.consumersLock.RUnlock()
-
-				for e := es.consumers.Front(); e != nil; e = e.Next() {
-					if e.Value.(*consumer) == c {
-						toRemoveEls = append(toRemoveEls, e)
-					}
+func controlProcess(es *eventSource) {
+	es.startFanOut()
+	for {
+		select {
+		case em := <-es.sink:
+			// consumers registered before the message was sent get it
+			es.addPending()
+			es.receive(em)
+		case <-es.reorder.expiry():
+			for _, em := range es.reorder.expired(time.Now()) {
+				es.dispatch(em)
+			}
+		case <-es.throttle.expiry():
+			es.release(es.throttle.expired(time.Now()))
+		case <-es.close:
+			defer close(es.finished)
+
+			// register consumers and deliver messages which came before
+			// closing
+			for pending := true; pending; {
+				select {
+				case c := <-es.add:
+					es.addConsumer(c)
+				case em := <-es.sink:
+					es.receive(em)
+				default:
+					pending = false
 				}
-			}()
-			func() {
-				es.consumersLock.Lock()
-				defer es.consumersLock.Unlock()
+			}
+			if es.reorder != nil {
+				for _, em := range es.reorder.flush() {
+					es.dispatch(em)
+				}
+			}
+			if es.throttle != nil {
+				es.release(es.throttle.flush())
+			}
+
+			// senders give up from now on, channels aren't closed so
+			// late senders don't panic
+			close(es.stopped)
 
-				for _, e := range toRemoveEls {
-					es.consumers.Remove(e)
+			es.consumers.each(func(c *consumer) {
+				c.closeIn()
+				es.closedConsumers = append(es.closedConsumers, c)
+			})
+
+			// close consumers which have been queued for adding meanwhile,
+			// the ones queued later are closed by their senders
+			for pending := true; pending; {
+				select {
+				case c := <-es.add:
+					c.closeIn()
+					es.closedConsumers = append(es.closedConsumers, c)
+				default:
+					pending = false
 				}
-			}()
-			close(c.in)
+			}
+
+			es.logger.Info("Closed the event source", "consumers", len(es.closedConsumers))
+			es.consumers.clear()
+			es.stopFanOut()
+			return
+		case c := <-es.add:
+			es.addConsumer(c)
+		case r := <-es.resize:
+			r.result <- es.resizeConsumerBuffer(r.id, r.size)
+		case c := <-es.staled:
+			// a consumer is passed to staled only once, but make sure its
+			// buffer isn't closed twice anyway
+			if es.consumers.remove(c) {
+				c.closeIn()
+			}
+			// the consumer is gone, messages still queued for it aren't
+			// worth writing
+			c.discardQueued(c.in)
 		}
 	}
 }
 
-// New creates new EventSource instance.
+// New creates new EventSource instance. customHeadersFunc returns raw
+// "Name: value" header lines added to every response, it may be nil;
+// Settings.Headers is the structured alternative.
 func New(settings *Settings, customHeadersFunc func(*http.Request) [][]byte) EventSource {
+	es := newEventSource(settings, customHeadersFunc)
+	go controlProcess(es)
+	return es
+}
+
+// newEventSource creates an eventSource without starting its control
+// goroutine.
+func newEventSource(settings *Settings, customHeadersFunc func(*http.Request) [][]byte) *eventSource {
 	if settings == nil {
 		settings = DefaultSettings()
 	}
 
 	es := new(eventSource)
 	es.customHeadersFunc = customHeadersFunc
+	es.onConnect = settings.OnConnect
+	es.onFrame = settings.OnFrame
+	es.onDisconnect = settings.OnDisconnect
 	es.sink = make(chan message, 1)
 	es.close = make(chan bool)
+	es.stopped = make(chan bool)
+	es.finished = make(chan bool)
 	es.staled = make(chan *consumer, 1)
-	es.add = make(chan *consumer)
-	es.consumers = list.New()
+	es.add = make(chan *consumer, settings.AddBufferSize)
+	es.resize = make(chan resizeRequest)
+	es.consumers = newRegistry()
+	es.consumerBufferSize = settings.ConsumerBufferSize
+	if es.consumerBufferSize <= 0 {
+		es.consumerBufferSize = 10
+	}
+	es.overflowPolicy = settings.OverflowPolicy
+	es.slowConsumerDrops = settings.SlowConsumerDrops
+	es.slowConsumerLag = settings.SlowConsumerLag
+	es.maxQueuedBytes = settings.MaxQueuedBytes
+	es.maxBatchSize = settings.MaxBatchSize
+	es.flushInterval = settings.FlushInterval
+	es.messageTTL = settings.MessageTTL
+	es.overflowTimeout = settings.OverflowTimeout
+	if es.overflowTimeout <= 0 {
+		es.overflowTimeout = time.Second
+	}
+	if workers := settings.FanOutWorkers; workers > 1 {
+		if workers > registryShards {
+			workers = registryShards
+		}
+		es.fanOut = make([]chan *fanOutJob, workers)
+		for i := range es.fanOut {
+			es.fanOut[i] = make(chan *fanOutJob)
+		}
+		es.stats.partitions = make([]partitionCounts, workers)
+	}
 	es.timeout = settings.Timeout
 	es.idleTimeout = settings.IdleTimeout
+	es.keepAliveInterval = settings.KeepAliveInterval
 	es.closeOnTimeout = settings.CloseOnTimeout
-	es.gzip = settings.Gzip
-	go controlProcess(es)
+	es.encoders = newEncoders(settings.Encodings, settings.Gzip, settings.GzipLevel)
+	es.alwaysEmitData = settings.AlwaysEmitData
+	es.errorEvent = settings.ErrorEvent
+	if es.errorEvent == "" {
+		es.errorEvent = "error"
+	}
+	es.farewellEvent = settings.FarewellEvent
+	if es.farewellEvent == "" {
+		es.farewellEvent = "farewell"
+	}
+	es.shutdownEvent = settings.ShutdownEvent
+	es.retiredStatus = settings.RetiredStatus
+	if es.retiredStatus == 0 {
+		es.retiredStatus = http.StatusGone
+	}
+	es.filterChangedEvent = settings.FilterChangedEvent
+	es.watchClientClose = settings.WatchClientClose
+	es.streamingHeaders = settings.StreamingHeaders
+	es.strict = settings.Strict
+	es.suppressDuplicates = settings.SuppressDuplicateFrames
+	if settings.SuppressDuplicateEvents {
+		es.duplicates = newDuplicateFilter(settings.MaxDuplicateSuppression)
+	}
+	es.dataField = settings.DataFieldName
+	if strings.ContainsAny(es.dataField, ":\r\n") {
+		panic(fmt.Sprintf("eventsource: invalid data field name %q", es.dataField))
+	}
+	es.maxGoroutines = int64(settings.MaxGoroutines)
+	es.maxConsumers = int64(settings.MaxConsumers)
+	retryAfter := settings.MaxConsumersRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = 5 * time.Second
+	}
+	es.retryAfter = strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	es.consumerMetadata = settings.ConsumerMetadata
+	es.onConnectSend = settings.OnConnectSend
+	es.onBroadcast = settings.OnBroadcast
+	es.onError = settings.OnError
+	es.logger = settings.Logger
+	if es.logger == nil {
+		es.logger = stdLogger{}
+	}
+	es.consumerFilter = settings.ConsumerFilter
+	es.cors = settings.CORS
+	es.authorize = settings.Authorize
+	es.headersFunc = settings.Headers
+	es.store = settings.EventStore
+	if es.store == nil && settings.HistorySize > 0 {
+		es.store = newHistory(settings.HistorySize)
+	}
+	if settings.StickyEvents {
+		es.sticky = newStickyEvents()
+	}
+	es.autoIDs = settings.AutoIDs
+	if store, ok := es.store.(LastEventIDStore); ok && es.autoIDs {
+		es.seedSequence(store)
+	}
+	if settings.ReorderWindow > 0 {
+		gapEvent := settings.ReorderGapEvent
+		if gapEvent == "" {
+			gapEvent = "gap"
+		}
+		es.reorder = newReorderBuffer(settings.ReorderWindow, gapEvent)
+	}
+	if len(settings.Throttle) > 0 {
+		es.throttle = newThrottle(settings.Throttle)
+	}
+	if len(settings.Serializers) > 0 {
+		es.serializers = make(map[string]Serializer, len(settings.Serializers))
+		for contentType, serializer := range settings.Serializers {
+			es.serializers[strings.ToLower(contentType)] = serializer
+		}
+	}
+	if settings.MaxAcceptRate > 0 {
+		es.acceptLimiter = newTokenBucket(settings.MaxAcceptRate, settings.AcceptBurst)
+	}
+	if settings.ConnectionKey != nil && settings.MaxConnectionsPerKey > 0 {
+		es.connectionKey = settings.ConnectionKey
+		es.connectionCaps = newConnectionCaps(settings.MaxConnectionsPerKey, settings.EvictOldestConnection)
+	}
+	if settings.MaxAcceptRatePerIP > 0 {
+		es.ipAcceptLimiter = newKeyedLimiter(settings.MaxAcceptRatePerIP, settings.AcceptBurstPerIP)
+	}
+	es.terminator = []byte("\n")
+	if settings.ExtraBlankLines > 0 {
+		es.terminator = bytes.Repeat([]byte("\n"), settings.ExtraBlankLines+1)
+	}
+	es.minRetry = settings.MinRetry
+	if es.minRetry < time.Millisecond {
+		es.minRetry = time.Millisecond
+	}
 	return es
 }
 
+func (es *eventSource) nextConsumerID() ConsumerID {
+	return ConsumerID(atomic.AddUint64(&es.lastConsumerID, 1))
+}
+
+// consumer returns the consumer with the given ID or nil.
+func (es *eventSource) consumer(id ConsumerID) *consumer {
+	return es.consumers.get(id)
+}
+
+// resizeConsumerBuffer is called by the control goroutine, the only one
+// sending to consumer buffers, so the buffer can be replaced safely once
+// the consumer goroutine has moved queued messages to the new one.
+func (es *eventSource) resizeConsumerBuffer(id ConsumerID, size int) error {
+	c := es.consumer(id)
+	if c == nil || c.isStaled() {
+		return ErrConsumerNotFound
+	}
+	return es.resizeBuffer(c, size)
+}
+
+// resizeBuffer replaces the message buffer of the consumer.
+func (es *eventSource) resizeBuffer(c *consumer, size int) error {
+	in := make(chan queuedFrame, size)
+	select {
+	case c.resize <- in:
+		<-c.resized
+		// consumer infos are read holding the shard lock
+		es.consumers.update(c, func() { c.in = in })
+		return nil
+	case <-c.done:
+		return ErrConsumerNotFound
+	}
+}
+
+func (es *eventSource) SetConsumerFilter(id ConsumerID, filter func(event, id string) bool) error {
+	fm := &filterMessage{
+		id:     id,
+		result: make(chan error, 1),
+	}
+	if filter != nil {
+		fm.filter = func(e Event) bool {
+			return filter(e.Type, e.ID)
+		}
+	}
+	if es.filterChangedEvent != "" {
+		notification := es.newEventMessage("", es.filterChangedEvent, "")
+		// the event isn't dispatched by browsers without data
+		notification.alwaysData = true
+		fm.message = notification
+	}
+	if err := es.sendMessage(fm); err != nil {
+		return err
+	}
+	return es.await(fm.result)
+}
+
+func (es *eventSource) SetConsumerValue(id ConsumerID, value interface{}) error {
+	vm := &valueMessage{
+		id:     id,
+		value:  value,
+		result: make(chan error, 1),
+	}
+	if err := es.sendMessage(vm); err != nil {
+		return err
+	}
+	return es.await(vm.result)
+}
+
+func (es *eventSource) ResizeConsumerBuffer(id ConsumerID, size int) error {
+	if size < 1 {
+		return ErrInvalidBufferSize
+	}
+
+	r := resizeRequest{id, size, make(chan error, 1)}
+	select {
+	case es.resize <- r:
+		return <-r.result
+	case <-es.stopped:
+		return ErrClosed
+	}
+}
+
+// Close may be called more than once, it returns once the EventSource has
+// been closed.
 func (es *eventSource) Close() {
-	es.close <- true
+	select {
+	case es.close <- true:
+	case <-es.stopped:
+	}
+	<-es.finished
+}
+
+// CloseWithTimeout gives up if the control goroutine doesn't finish closing
+// in time, e.g. because it's blocked by a callback. Consumer goroutines are
+// stopped then, waiting for them to close their connections up to timeout
+// once more, and the EventSource finishes closing in the background once
+// the control goroutine gets unblocked.
+func (es *eventSource) CloseWithTimeout(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case es.close <- true:
+	case <-es.stopped:
+	case <-timer.C:
+		go es.Close()
+		es.stopConsumers(timeout)
+		return ErrCloseTimeout
+	}
+
+	select {
+	case <-es.finished:
+		return nil
+	case <-timer.C:
+		es.stopConsumers(timeout)
+		return ErrCloseTimeout
+	}
+}
+
+// stopConsumers makes the goroutines of the registered consumers close their
+// connections without the control goroutine, and waits for them to exit up
+// to timeout. A goroutine blocked writing exits once the write times out.
+func (es *eventSource) stopConsumers(timeout time.Duration) {
+	var stopped []*consumer
+	es.consumers.each(func(c *consumer) {
+		c.stop()
+		stopped = append(stopped, c)
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, c := range stopped {
+		select {
+		case <-c.done:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Shutdown returns ErrClosed if it has been called already or the
+// EventSource has been closed. Consumers are left to their idle timeouts
+// if ctx is done before they are closed.
+func (es *eventSource) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&es.closing, 0, 1) {
+		return ErrClosed
+	}
+	es.logger.Info("Shutting down the event source", "consumers", es.consumers.len())
+
+	if es.shutdownEvent != "" {
+		m := es.newEventMessage("", es.shutdownEvent, "")
+		// the event isn't dispatched by browsers without data
+		m.alwaysData = true
+		select {
+		case es.sink <- m:
+		case <-es.stopped:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case es.close <- true:
+	case <-es.stopped:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-es.finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// consumer goroutines exit once they have written queued messages
+	for _, c := range es.closedConsumers {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (es *eventSource) CloseWithError(reason string) {
+	data, _ := json.Marshal(struct {
+		Reason string `json:"reason"`
+	}{reason})
+	m := es.newEventMessage(string(data), es.errorEvent, "")
+	m.priority = true
+	es.sendMessage(m)
+	es.Close()
+}
+
+// Retire does nothing if the EventSource has been retired already.
+func (es *eventSource) Retire(message string) {
+	if !atomic.CompareAndSwapInt32(&es.retired, 0, 1) {
+		return
+	}
+	es.logger.Info("Retiring the event source", "consumers", es.consumers.len())
+	es.retiredMessage.Store(message)
+	m := es.newEventMessage(message, es.farewellEvent, "")
+	m.priority = true
+	es.sendMessage(m)
+	es.Close()
 }
 
 // ServeHTTP implements http.Handler interface.
 func (es *eventSource) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	cons, err := newConsumer(resp, req, es)
+	if !es.acceptMethod(resp, req) {
+		return
+	}
+
+	if message, ok := es.retiredMessage.Load().(string); ok {
+		http.Error(resp, message, es.retiredStatus)
+		return
+	}
+
+	if es.isClosed() {
+		http.Error(resp, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if !es.acceptRate(resp, req) {
+		return
+	}
+
+	if !es.authorized(resp, req) {
+		return
+	}
+
+	status, header := es.streamHeader(req)
+	if status != http.StatusOK {
+		es.writeStatus(resp, req, status, header)
+		return
+	}
+
+	if !es.stats.reserveGoroutine(es.maxGoroutines) {
+		http.Error(resp, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	// concurrent requests over the limit are all rejected, so it's never
+	// exceeded
+	if es.maxConsumers > 0 && es.stats.goroutinesNow() > es.maxConsumers {
+		es.stats.releaseGoroutine()
+		resp.Header().Set("Retry-After", es.retryAfter)
+		http.Error(resp, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	var key string
+	if es.connectionCaps != nil {
+		key = es.connectionKey(req)
+	}
+	if key != "" {
+		ok, oldest := es.connectionCaps.reserve(key)
+		if !ok {
+			es.stats.releaseGoroutine()
+			http.Error(resp, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		if oldest != nil {
+			es.closeConsumer(oldest.id, nil, ErrConnectionLimit)
+		}
+	}
+
+	cons, err := newConsumer(resp, req, es, header)
 	if err != nil {
-		log.Print("Can't create connection to a consumer: ", err)
+		es.stats.releaseGoroutine()
+		if key != "" {
+			es.connectionCaps.unreserve(key)
+		}
+		es.logger.Error("Can't create connection to a consumer", "remote_addr", req.RemoteAddr, "error", err)
 		return
 	}
-	es.add <- cons
+	// the connection is closed on error
+	cons.register(req)
+	if key != "" {
+		es.connectionCaps.track(key, cons)
+	}
+	if _, ok := cons.conn.(*responseConn); ok {
+		// the response can't be used once the handler returns
+		<-cons.done
+	}
 }
 
-func (es *eventSource) sendMessage(m message) {
-	es.sink <- m
+// acceptRate takes a token from the accept rate limiters, the per-IP one
+// first so rejected clients don't use up the global rate. It responds with
+// 429 Too Many Requests and reports false if a limit is reached.
+func (es *eventSource) acceptRate(resp http.ResponseWriter, req *http.Request) bool {
+	now := time.Now()
+	ok, wait := true, time.Duration(0)
+	if es.ipAcceptLimiter != nil {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ip = req.RemoteAddr
+		}
+		ok, wait = es.ipAcceptLimiter.take(ip, now)
+	}
+	if ok && es.acceptLimiter != nil {
+		ok, wait = es.acceptLimiter.take(now)
+	}
+	if ok {
+		return true
+	}
+
+	// clients shouldn't come back sooner than they would reconnect
+	if wait < es.minRetry {
+		wait = es.minRetry
+	}
+	resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(resp, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
 }
 
-func (es *eventSource) SendEventMessage(data, event, id string) {
-	em := &eventMessage{id, event, data}
-	es.sendMessage(em)
+// AttachConn streams messages to conn without the HTTP handshake (unless
+// WithResponseHeaders is given), e.g. for raw TCP bridges. Connection
+// hooks get a nil request unless one is given to WithResponseHeaders.
+func (es *eventSource) AttachConn(conn net.Conn, options ...ConsumerOption) (ConsumerID, error) {
+	var o consumerOptions
+	for _, option := range options {
+		option(&o)
+	}
+
+	if es.isClosed() {
+		return 0, ErrClosed
+	}
+
+	if !es.stats.reserveGoroutine(es.maxGoroutines) {
+		return 0, ErrGoroutineLimit
+	}
+
+	var header http.Header
+	if o.writeHeaders {
+		_, header = es.streamHeader(o.req)
+	}
+	cons, err := attachConsumer(conn, o.req, es, header)
+	if err != nil {
+		es.stats.releaseGoroutine()
+		return 0, err
+	}
+	if o.metadata != nil {
+		cons.metadata = o.metadata
+	}
+	if err := cons.register(o.req); err != nil {
+		return 0, err
+	}
+	return cons.id, nil
 }
 
-func (m *retryMessage) prepareMessage() []byte {
-	return []byte(fmt.Sprintf("retry: %d\n\n", m.retry/time.Millisecond))
+// isClosed reports whether the EventSource is shutting down or has been
+// closed.
+func (es *eventSource) isClosed() bool {
+	select {
+	case <-es.stopped:
+		return true
+	default:
+		return atomic.LoadInt32(&es.closing) != 0
+	}
 }
 
-func (es *eventSource) SendRetryMessage(t time.Duration) {
-	es.sendMessage(&retryMessage{t})
+// sendMessage queues the message for the control goroutine, or returns
+// ErrClosed if it has stopped.
+func (es *eventSource) sendMessage(m message) error {
+	select {
+	case <-es.stopped:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case es.sink <- m:
+		return nil
+	case <-es.stopped:
+		return ErrClosed
+	}
+}
+
+// await returns the result of a message sent to the control goroutine, or
+// ErrClosed if it stopped without taking the message.
+func (es *eventSource) await(result chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-es.finished:
+		select {
+		case err := <-result:
+			return err
+		default:
+			return ErrClosed
+		}
+	}
+}
+
+func (es *eventSource) newEventMessage(data, event, id string) *eventMessage {
+	return &eventMessage{
+		id:         id,
+		event:      event,
+		data:       data,
+		alwaysData: es.alwaysEmitData,
+		dataField:  es.dataField,
+		ttl:        es.messageTTL,
+	}
+}
+
+// validate returns the error for an illegal event name or id in strict
+// mode.
+func (es *eventSource) validate(event, id string) error {
+	if !es.strict {
+		return nil
+	}
+	if strings.ContainsAny(id, "\r\n\x00") {
+		return ErrInvalidID
+	}
+	if strings.ContainsAny(event, "\r\n\x00") {
+		return ErrInvalidEventName
+	}
+	return nil
+}
+
+func (es *eventSource) Send(e Event) error {
+	if err := es.validate(e.Type, e.ID); err != nil {
+		return err
+	}
+	return es.sendMessage(es.newEvent(e))
+}
+
+// newEvent returns the message of e.
+func (es *eventSource) newEvent(e Event) *eventMessage {
+	m := es.newEventMessage(e.Data, e.Type, e.ID)
+	m.comment = e.Comment
+	if e.Retry > 0 {
+		m.retry = es.clampRetry(e.Retry)
+	}
+	if e.TTL > 0 {
+		m.ttl = e.TTL
+	}
+	return m
+}
+
+func (es *eventSource) SendEvents(events []Event) error {
+	bm, err := es.newBatch(events)
+	if err != nil || bm == nil {
+		return err
+	}
+	return es.sendMessage(bm)
+}
+
+// newBatch returns the message of events, or nil if there are none.
+func (es *eventSource) newBatch(events []Event) (*batchMessage, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	messages := make([]*eventMessage, len(events))
+	for i, e := range events {
+		if err := es.validate(e.Type, e.ID); err != nil {
+			return nil, err
+		}
+		messages[i] = es.newEvent(e)
+	}
+	return newBatchMessage(messages, es.terminator), nil
+}
+
+// newBatchMessage returns the batch of the events, expiring with the
+// shortest positive TTL of them.
+func newBatchMessage(events []*eventMessage, terminator []byte) *batchMessage {
+	bm := &batchMessage{events: events, terminator: terminator}
+	for _, m := range events {
+		if m.ttl > 0 && (bm.ttl == 0 || m.ttl < bm.ttl) {
+			bm.ttl = m.ttl
+		}
+	}
+	return bm
+}
+
+func (es *eventSource) SendEventMessage(data, event, id string) error {
+	return es.Send(Event{ID: id, Type: event, Data: data})
+}
+
+func (es *eventSource) SendJSON(v interface{}, event, id string) error {
+	// JSON is a single line, newlines in strings are escaped
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return es.SendEventMessage(string(data), event, id)
+}
+
+// sendCounted sends the message and waits for its delivery counts.
+func (es *eventSource) sendCounted(m message) (delivered, dropped int, err error) {
+	cm := &countedMessage{m, make(chan deliveryCount, 1)}
+	if err := es.sendMessage(cm); err != nil {
+		return 0, 0, err
+	}
+
+	select {
+	case count := <-cm.result:
+		return count.delivered, count.dropped, nil
+	case <-es.finished:
+		select {
+		case count := <-cm.result:
+			return count.delivered, count.dropped, nil
+		default:
+			return 0, 0, ErrClosed
+		}
+	}
+}
+
+func (es *eventSource) SendEventMessageCounted(data, event, id string) (delivered, dropped int, err error) {
+	if err := es.validate(event, id); err != nil {
+		return 0, 0, err
+	}
+	return es.sendCounted(es.newEventMessage(data, event, id))
+}
+
+func (m *channelMessage) messageFor(c *consumer) message {
+	for _, channel := range c.channels {
+		if channel == m.channel {
+			return m.message
+		}
+	}
+	return nil
+}
+
+func (es *eventSource) SendEventMessageToChannel(data, event, id, channel string) error {
+	if err := es.validate(event, id); err != nil {
+		return err
+	}
+	return es.sendMessage(&channelMessage{es.newEventMessage(data, event, id), channel})
+}
+
+func (es *eventSource) SendEventMessageTimeout(data, event, id string, timeout time.Duration) error {
+	if err := es.validate(event, id); err != nil {
+		return err
+	}
+
+	select {
+	case <-es.stopped:
+		return ErrClosed
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case es.sink <- es.newEventMessage(data, event, id):
+		return nil
+	case <-es.stopped:
+		return ErrClosed
+	case <-timer.C:
+		return ErrSendTimeout
+	}
+}
+
+// TrySendEventMessage returns false if the event is invalid in strict mode
+// or the EventSource has been closed.
+func (es *eventSource) TrySendEventMessage(data, event, id string) bool {
+	if es.validate(event, id) != nil {
+		return false
+	}
+
+	select {
+	case <-es.stopped:
+		return false
+	default:
+	}
+
+	select {
+	case es.sink <- es.newEventMessage(data, event, id):
+		return true
+	default:
+		return false
+	}
+}
+
+func (es *eventSource) SendEventMessageContext(ctx context.Context, data, event, id string) error {
+	if err := es.validate(event, id); err != nil {
+		return err
+	}
+
+	select {
+	case <-es.stopped:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	m := es.newEventMessage(data, event, id)
+	m.ctx = ctx
+	m.sent = time.Now()
+	select {
+	case es.sink <- m:
+		return nil
+	case <-es.stopped:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (es *eventSource) SendEventMessageVariants(variants map[string]string, event, id string) error {
+	if err := es.validate(event, id); err != nil {
+		return err
+	}
+	vm := &variantMessage{make(map[string]*eventMessage, len(variants))}
+	for capability, data := range variants {
+		vm.variants[capability] = es.newEventMessage(data, event, id)
+	}
+	return es.sendMessage(vm)
+}
+
+// SendEventMessageTo returns ErrConsumerNotFound if the consumer isn't
+// connected anymore.
+func (es *eventSource) SendEventMessageTo(id ConsumerID, data, event, eventID string) error {
+	if err := es.validate(event, eventID); err != nil {
+		return err
+	}
+	return es.sendTo(id, es.newEventMessage(data, event, eventID))
+}
+
+// sendTo sends m to the consumer with the id only.
+func (es *eventSource) sendTo(id ConsumerID, m message) error {
+	tm := &targetedMessage{
+		message: m,
+		target: func() *consumer {
+			if c := es.consumer(id); c != nil && !c.isStaled() {
+				return c
+			}
+			return nil
+		},
+		result: make(chan error, 1),
+	}
+	if err := es.sendMessage(tm); err != nil {
+		return err
+	}
+	return es.await(tm.result)
+}
+
+// CloseConsumer records ErrConsumerClosed as the last error of the
+// consumer. It's closed once the messages queued before, then finalEvent,
+// have been written. If the full buffer drops finalEvent, it's written
+// ahead of the queued messages instead, or ErrBufferOverflow is returned
+// if it can't be queued at all, the consumer being closed anyway.
+func (es *eventSource) CloseConsumer(id ConsumerID, finalEvent *Event) error {
+	var final message
+	if finalEvent != nil {
+		if err := es.validate(finalEvent.Type, finalEvent.ID); err != nil {
+			return err
+		}
+		final = es.newEvent(*finalEvent)
+	}
+	return es.closeConsumer(id, final, ErrConsumerClosed)
+}
+
+// closeConsumer closes the consumer with the id once final, unless it's
+// nil, has been queued, recording err as its last error.
+func (es *eventSource) closeConsumer(id ConsumerID, final message, err error) error {
+	tm := &targetedMessage{
+		message: final,
+		target: func() *consumer {
+			if c := es.consumer(id); c != nil && !c.isStaled() {
+				return c
+			}
+			return nil
+		},
+		closeErr: err,
+		result:   make(chan error, 1),
+	}
+	if err := es.sendMessage(tm); err != nil {
+		return err
+	}
+	return es.await(tm.result)
+}
+
+func (es *eventSource) SendEventMessageToLatest(data, event, id string) error {
+	if err := es.validate(event, id); err != nil {
+		return err
+	}
+	tm := &targetedMessage{
+		message: es.newEventMessage(data, event, id),
+		target:  es.consumers.latest,
+		result:  make(chan error, 1),
+	}
+	if err := es.sendMessage(tm); err != nil {
+		return err
+	}
+	return es.await(tm.result)
+}
+
+func (m *retryMessage) appendMessage(b []byte) []byte {
+	return appendRetry(b, m.retry)
+}
+
+// clampRetry limits t to the [minRetry, maxRetry] range.
+func (es *eventSource) clampRetry(t time.Duration) time.Duration {
+	if t < es.minRetry {
+		return es.minRetry
+	}
+	if t > maxRetry {
+		return maxRetry
+	}
+	return t
+}
+
+func (es *eventSource) SendRetryMessage(t time.Duration) error {
+	return es.sendMessage(&retryMessage{es.clampRetry(t)})
+}
+
+func (es *eventSource) SendRetryMessageCounted(t time.Duration) (delivered, dropped int, err error) {
+	return es.sendCounted(&retryMessage{es.clampRetry(t)})
+}
+
+func (m *matchMessage) messageFor(c *consumer) message {
+	for key, value := range m.match {
+		if v, ok := c.metadata[key]; !ok || v != value {
+			return nil
+		}
+	}
+	return m.message
+}
+
+func (es *eventSource) SendRetryMessageWhere(match map[string]string, t time.Duration) error {
+	return es.sendMessage(&matchMessage{&retryMessage{es.clampRetry(t)}, match})
+}
+
+func (m *commentMessage) appendMessage(b []byte) []byte {
+	return appendLines(b, "", m.comment)
+}
+
+func (es *eventSource) Heartbeat() error {
+	return es.sendMessage(&commentMessage{comment: "heartbeat", priority: true})
+}
+
+func (es *eventSource) SendComment(text string) error {
+	return es.sendMessage(&commentMessage{comment: text})
+}
+
+func (es *eventSource) SendCommentTo(id ConsumerID, text string) error {
+	return es.sendTo(id, &commentMessage{comment: text})
+}
+
+// reportError calls the OnError hook.
+func (es *eventSource) reportError(id ConsumerID, err error) {
+	if es.onError != nil {
+		es.onError(id, err)
+	}
+}
+
+func (es *eventSource) LastEventID() string {
+	id, _ := es.lastEventID.Load().(string)
+	return id
 }
 
 func (es *eventSource) ConsumersCount() int {
-	es.consumersLock.RLock()
-	defer es.consumersLock.RUnlock()
+	return es.consumers.len()
+}
+
+func (es *eventSource) Consumers() []ConsumerInfo {
+	return es.consumerInfos()
+}
+
+func (es *eventSource) PruneIdle(olderThan time.Duration) int {
+	threshold := time.Now().Add(-olderThan).UnixNano()
+	idle := make([]*consumer, 0)
+	es.consumers.each(func(c *consumer) {
+		if atomic.LoadInt64(&c.lastActivity) < threshold && c.markStaled() {
+			c.setLastErr(ErrIdleTimeout)
+			idle = append(idle, c)
+		}
+	})
+
+	for _, c := range idle {
+		select {
+		case es.staled <- c:
+		case <-es.stopped:
+			// closing closes them all
+			return len(idle)
+		}
+	}
+	return len(idle)
+}
+
+func (es *eventSource) Stats() Stats {
+	return es.stats.snapshot(false)
+}
 
-	return es.consumers.Len()
+func (es *eventSource) StatsAndReset() Stats {
+	return es.stats.snapshot(true)
 }
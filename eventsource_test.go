@@ -1,11 +1,22 @@
 package eventsource
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -69,12 +80,20 @@ func read(t *testing.T, c net.Conn) []byte {
 }
 
 func startEventStream(t *testing.T, e *testEnv) (net.Conn, []byte) {
+	return startEventStreamURI(t, e, "/")
+}
+
+func startEventStreamURI(t *testing.T, e *testEnv, uri string) (net.Conn, []byte) {
+	return startEventStreamRequest(t, e, "GET "+uri+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+}
+
+func startEventStreamRequest(t *testing.T, e *testEnv, request string) (net.Conn, []byte) {
 	url := e.server.URL
 	t.Log("open connection")
 	conn, err := net.Dial("tcp", strings.Replace(url, "http://", "", 1))
 	checkError(t, err)
-	t.Log("send GET request to the connection")
-	_, err = conn.Write([]byte("GET / HTTP/1.1\n\n"))
+	t.Logf("send request to the connection:\n%s", request)
+	_, err = conn.Write([]byte(request))
 	checkError(t, err)
 
 	resp := read(t, conn)
@@ -229,3 +248,3657 @@ func TestIdleTimeout(t *testing.T) {
 		t.Fatalf("Expected 0 customer but got %d", ccount)
 	}
 }
+
+func TestRetryMessageRounding(t *testing.T) {
+	cases := []struct {
+		retry    time.Duration
+		expected string
+	}{
+		{999 * time.Microsecond, "retry: 1\n"},
+		{1500 * time.Microsecond, "retry: 2\n"},
+		{1499 * time.Microsecond, "retry: 1\n"},
+		{3 * time.Second, "retry: 3000\n"},
+	}
+
+	for _, c := range cases {
+		m := &retryMessage{c.retry}
+		if got := string(m.appendMessage(nil)); got != c.expected {
+			t.Errorf("retry %v: expected %q, got %q", c.retry, c.expected, got)
+		}
+	}
+}
+
+func TestRetryMessageClamping(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MinRetry = 500 * time.Millisecond
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("send zero retry message")
+	e.eventSource.SendRetryMessage(0)
+	expectResponse(t, conn, "retry: 500\n\n")
+
+	t.Log("send negative retry message")
+	e.eventSource.SendRetryMessage(-time.Second)
+	expectResponse(t, conn, "retry: 500\n\n")
+
+	t.Log("send huge retry message")
+	e.eventSource.SendRetryMessage(1000 * time.Hour)
+	expectResponse(t, conn, "retry: 86400000\n\n")
+}
+
+func TestRetryMessageDefaultFloor(t *testing.T) {
+	e := setupWithCustomSettings(t, &Settings{Timeout: 2 * time.Second, IdleTimeout: time.Minute})
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("send sub-millisecond retry message")
+	e.eventSource.SendRetryMessage(100 * time.Microsecond)
+	expectResponse(t, conn, "retry: 1\n\n")
+}
+
+func TestAlwaysEmitData(t *testing.T) {
+	t.Log("id-only message without AlwaysEmitData")
+	m := &eventMessage{id: "1"}
+	if got := string(m.appendMessage(nil)); got != "id: 1\n" {
+		t.Errorf("expected %q, got %q", "id: 1\n", got)
+	}
+
+	settings := DefaultSettings()
+	settings.AlwaysEmitData = true
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("send id-only message")
+	e.eventSource.SendEventMessage("", "", "1")
+	expectResponse(t, conn, "id: 1\ndata: \n\n")
+
+	t.Log("send event-only message")
+	e.eventSource.SendEventMessage("", "ping", "")
+	expectResponse(t, conn, "event: ping\ndata: \n\n")
+
+	t.Log("send message with data")
+	e.eventSource.SendEventMessage("test", "", "2")
+	expectResponse(t, conn, "id: 2\ndata: test\n\n")
+}
+
+func TestPruneIdle(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	conn2, _ := startEventStream(t, e)
+	defer conn2.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	ccount := e.eventSource.ConsumersCount()
+	if ccount != 2 {
+		t.Fatalf("Expected 2 customers but got %d", ccount)
+	}
+
+	pruned := e.eventSource.PruneIdle(200 * time.Millisecond)
+	if pruned != 1 {
+		t.Fatalf("Expected 1 pruned customer but got %d", pruned)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	ccount = e.eventSource.ConsumersCount()
+	if ccount != 1 {
+		t.Fatalf("Expected 1 customer but got %d", ccount)
+	}
+
+	t.Log("send message 'test' to remaining connection")
+	e.eventSource.SendEventMessage("test", "", "")
+	expectResponse(t, conn2, "data: test\n\n")
+}
+
+func TestConnectionHooks(t *testing.T) {
+	connected := make(chan ConsumerID, 1)
+	frames := make(chan int, 1)
+	disconnected := make(chan ConsumerID, 1)
+
+	settings := DefaultSettings()
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		if req == nil {
+			t.Error("OnConnect got nil request")
+		}
+		connected <- id
+	}
+	settings.OnFrame = func(id ConsumerID, size int) {
+		frames <- size
+	}
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		// the consumer is pruned below
+		if err != ErrIdleTimeout {
+			t.Errorf("expected ErrIdleTimeout, got %v", err)
+		}
+		disconnected <- id
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	var id ConsumerID
+	select {
+	case id = <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("OnConnect wasn't called")
+	}
+
+	e.eventSource.SendEventMessage("test", "", "")
+	expectResponse(t, conn, "data: test\n\n")
+	select {
+	case size := <-frames:
+		if size != len("data: test\n\n") {
+			t.Errorf("expected frame size %d, got %d", len("data: test\n\n"), size)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnFrame wasn't called")
+	}
+
+	e.eventSource.PruneIdle(0)
+	select {
+	case got := <-disconnected:
+		if got != id {
+			t.Errorf("expected disconnected consumer %d, got %d", id, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDisconnect wasn't called")
+	}
+}
+
+// benchmarkConnect measures connection setup time. If broadcast is set,
+// the control goroutine is kept busy broadcasting messages meanwhile.
+func benchmarkConnect(b *testing.B, settings *Settings, broadcast bool) {
+	es := New(settings, nil)
+	defer es.Close()
+	server := httptest.NewServer(es)
+	defer server.Close()
+	addr := strings.Replace(server.URL, "http://", "", 1)
+
+	if broadcast {
+		done := make(chan bool)
+		stopped := make(chan bool)
+		defer func() {
+			close(done)
+			<-stopped
+			// let consumers finish writing pending messages
+			time.Sleep(100 * time.Millisecond)
+		}()
+		go func() {
+			defer close(stopped)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					es.SendEventMessage("tick", "", "")
+				}
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		resp := make([]byte, 1024)
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = conn.Read(resp)
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn.Close()
+		}
+	})
+}
+
+func BenchmarkConnect(b *testing.B) {
+	benchmarkConnect(b, nil, false)
+}
+
+func BenchmarkConnectDuringBroadcast(b *testing.B) {
+	benchmarkConnect(b, nil, true)
+}
+
+func BenchmarkConnectDuringBroadcastUnbuffered(b *testing.B) {
+	settings := DefaultSettings()
+	settings.AddBufferSize = 0
+	benchmarkConnect(b, settings, true)
+}
+
+func benchmarkFrame(b *testing.B, m message) {
+	es := newEventSource(nil, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		es.frame(m)
+	}
+}
+
+func BenchmarkFrame(b *testing.B) {
+	benchmarkFrame(b, &eventMessage{id: "12345", event: "tick", data: `{"price":42.5,"symbol":"ACME"}`})
+}
+
+func BenchmarkFrameMultiline(b *testing.B) {
+	benchmarkFrame(b, &eventMessage{id: "12345", event: "log", data: strings.Repeat("a line of text\r\n", 20)})
+}
+
+func BenchmarkFrameComment(b *testing.B) {
+	benchmarkFrame(b, &commentMessage{comment: "heartbeat"})
+}
+
+func TestSendEventMessageTimeout(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("send message 'test' with timeout")
+	err := e.eventSource.SendEventMessageTimeout("test", "", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, conn, "data: test\n\n")
+
+	t.Log("send messages to wedged control loop")
+	// no control goroutine drains the sink
+	es := &eventSource{sink: make(chan message, 1)}
+	err = es.SendEventMessageTimeout("test", "", "", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = es.SendEventMessageTimeout("test", "", "", 100*time.Millisecond)
+	if err != ErrSendTimeout {
+		t.Fatalf("expected ErrSendTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout fired after %v", elapsed)
+	}
+}
+
+func TestConsumerLastError(t *testing.T) {
+	disconnected := make(chan error, 1)
+	settings := DefaultSettings()
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		disconnected <- err
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+
+	t.Log("send messages to closed connection")
+	for i := 0; i < 10; i++ {
+		e.eventSource.SendEventMessage("test", "", "")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Fatal("expected write error, got nil")
+		}
+		t.Logf("got write error: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("consumer wasn't disconnected")
+	}
+}
+
+func TestConsumerIdleTimeoutError(t *testing.T) {
+	disconnected := make(chan error, 1)
+	settings := DefaultSettings()
+	settings.IdleTimeout = 100 * time.Millisecond
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		disconnected <- err
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	select {
+	case err := <-disconnected:
+		if err != ErrIdleTimeout {
+			t.Fatalf("expected ErrIdleTimeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("consumer wasn't disconnected")
+	}
+}
+
+func TestEventMessageVariants(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	connCompact, _ := startEventStreamURI(t, e, "/?features=binary,compactjson")
+	defer connCompact.Close()
+	connBinary, _ := startEventStreamURI(t, e, "/?features=binary")
+	defer connBinary.Close()
+
+	t.Log("send message with variants")
+	e.eventSource.SendEventMessageVariants(map[string]string{
+		"":            "verbose",
+		"compactjson": "compact",
+	}, "", "1")
+	expectResponse(t, conn, "id: 1\ndata: verbose\n\n")
+	expectResponse(t, connCompact, "id: 1\ndata: compact\n\n")
+	expectResponse(t, connBinary, "id: 1\ndata: verbose\n\n")
+
+	t.Log("send message without default variant")
+	e.eventSource.SendEventMessageVariants(map[string]string{
+		"binary": "bytes",
+	}, "", "2")
+	e.eventSource.SendEventMessage("test", "", "3")
+	time.Sleep(100 * time.Millisecond)
+	if resp := string(read(t, conn)); !strings.HasPrefix(resp, "id: 3\ndata: test\n\n") {
+		t.Errorf("expected only message 3, got:\n%s", resp)
+	}
+	expectResponse(t, connCompact, "id: 2\ndata: bytes\n\nid: 3\ndata: test\n\n")
+	expectResponse(t, connBinary, "id: 2\ndata: bytes\n\nid: 3\ndata: test\n\n")
+}
+
+func TestHeartbeat(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	conn2, _ := startEventStream(t, e)
+	conn2.(*net.TCPConn).SetLinger(0)
+	conn2.Close()
+
+	t.Log("send heartbeat")
+	e.eventSource.Heartbeat()
+	expectResponse(t, conn, ": heartbeat\n\n")
+
+	t.Log("send heartbeat to prune the closed connection")
+	e.eventSource.Heartbeat()
+	expectResponse(t, conn, ": heartbeat\n\n")
+
+	ccount := e.eventSource.ConsumersCount()
+	if ccount != 1 {
+		t.Fatalf("Expected 1 customer but got %d", ccount)
+	}
+
+	e.eventSource.Close()
+	if err := e.eventSource.Heartbeat(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestMessageTerminator(t *testing.T) {
+	messages := []message{
+		&eventMessage{id: "1", data: "test"},
+		&eventMessage{event: "notification", data: "test\n"},
+		&eventMessage{id: "1"},
+		&eventMessage{id: "1", alwaysData: true},
+		&variantMessage{map[string]*eventMessage{"": {id: "1", data: "test"}}},
+		&retryMessage{3 * time.Second},
+		&commentMessage{comment: "heartbeat"},
+		&commentMessage{comment: "multi\nline\n"},
+	}
+
+	for extra := 0; extra < 3; extra++ {
+		settings := DefaultSettings()
+		settings.ExtraBlankLines = extra
+		es := New(settings, nil).(*eventSource)
+
+		terminator := "\n" + strings.Repeat("\n", extra)
+		for _, m := range messages {
+			frame := string(es.frame(m))
+			if !strings.HasSuffix(frame, "\n"+terminator) || strings.HasSuffix(frame, "\n\n"+terminator) {
+				t.Errorf("extra blank lines %d: frame %q isn't terminated by exactly %q", extra, frame, terminator)
+			}
+		}
+		es.Close()
+	}
+}
+
+func TestExtraBlankLines(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ExtraBlankLines = 2
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("send message 'test'")
+	e.eventSource.SendEventMessage("test", "", "")
+	expectResponse(t, conn, "data: test\n\n\n\n")
+
+	t.Log("send retry message")
+	e.eventSource.SendRetryMessage(3 * time.Second)
+	expectResponse(t, conn, "retry: 3000\n\n\n\n")
+}
+
+func TestResizeConsumerBuffer(t *testing.T) {
+	connected := make(chan ConsumerID, 1)
+	settings := DefaultSettings()
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		connected <- id
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	id := <-connected
+
+	if err := e.eventSource.ResizeConsumerBuffer(id+1, 100); err != ErrConsumerNotFound {
+		t.Errorf("expected ErrConsumerNotFound, got %v", err)
+	}
+	if err := e.eventSource.ResizeConsumerBuffer(id, 0); err != ErrInvalidBufferSize {
+		t.Errorf("expected ErrInvalidBufferSize, got %v", err)
+	}
+
+	t.Log("resize consumer buffer while listing consumers")
+	listed := make(chan bool)
+	go func() {
+		defer close(listed)
+		for i := 0; i < 100; i++ {
+			e.eventSource.Consumers()
+		}
+	}()
+	if err := e.eventSource.ResizeConsumerBuffer(id, 1000); err != nil {
+		t.Fatal(err)
+	}
+	<-listed
+
+	t.Log("send burst of messages")
+	for i := 0; i < 500; i++ {
+		e.eventSource.SendEventMessage("test", "", strconv.Itoa(i))
+	}
+
+	var received []byte
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for !strings.Contains(string(received), "id: 499\n") {
+		resp := make([]byte, 4096)
+		n, err := conn.Read(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, resp[:n]...)
+	}
+	if n := strings.Count(string(received), "data: test\n\n"); n != 500 {
+		t.Errorf("expected 500 messages, got %d", n)
+	}
+
+	t.Log("shrink consumer buffer")
+	if err := e.eventSource.ResizeConsumerBuffer(id, 1); err != nil {
+		t.Fatal(err)
+	}
+	e.eventSource.SendEventMessage("test", "", "500")
+	expectResponse(t, conn, "id: 500\ndata: test\n\n")
+}
+
+func TestMaxAcceptRate(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MaxAcceptRate = 2
+	settings.AcceptBurst = 3
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		conn, resp := startEventStream(t, e)
+		defer conn.Close()
+
+		if strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+			accepted++
+			continue
+		}
+		if !strings.Contains(string(resp), "HTTP/1.1 429 Too Many Requests\r\n") {
+			t.Fatalf("expected 429 response, got:\n%s", resp)
+		}
+		if !strings.Contains(string(resp), "Retry-After: 1\r\n") {
+			t.Errorf("expected Retry-After header, got:\n%s", resp)
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("expected 3 accepted connections, got %d", accepted)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+
+	conn, resp := startEventStream(t, e)
+	defer conn.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("expected connection to be accepted after refill, got:\n%s", resp)
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	e := setup(t)
+	defer e.server.Close()
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("close with error")
+	e.eventSource.CloseWithError("upstream \"failure\"")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "event: error\ndata: {\"reason\":\"upstream \\\"failure\\\"\"}\n\n"
+	if string(resp) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, resp)
+	}
+}
+
+func TestReconnectionStats(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	conn2, _ := startEventStream(t, e)
+	defer conn2.Close()
+	conn3, _ := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 1\r\n\r\n")
+	defer conn3.Close()
+
+	stats := e.eventSource.Stats()
+	if stats.FirstConnections != 2 {
+		t.Errorf("expected 2 first connections, got %d", stats.FirstConnections)
+	}
+	if stats.Reconnections != 1 {
+		t.Errorf("expected 1 reconnection, got %d", stats.Reconnections)
+	}
+}
+
+func TestMaxGoroutines(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MaxGoroutines = 2
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	conn2, _ := startEventStream(t, e)
+	defer conn2.Close()
+
+	if goroutines := e.eventSource.Stats().Goroutines; goroutines != 2 {
+		t.Errorf("expected 2 goroutines, got %d", goroutines)
+	}
+
+	conn3, resp := startEventStream(t, e)
+	conn3.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 503 Service Unavailable\r\n") {
+		t.Fatalf("expected 503 response, got:\n%s", resp)
+	}
+
+	conn.Close()
+	e.eventSource.PruneIdle(0)
+	time.Sleep(100 * time.Millisecond)
+
+	conn4, resp := startEventStream(t, e)
+	defer conn4.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("expected connection to be accepted, got:\n%s", resp)
+	}
+}
+
+// countingConn counts and discards writes.
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return len(b), nil
+}
+
+func (c *countingConn) Close() error {
+	return nil
+}
+
+// hijackableRecorder is a ResponseWriter hijacked to conn.
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (r hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.conn, nil, nil
+}
+
+func BenchmarkNewConsumer(b *testing.B) {
+	es := New(nil, func(*http.Request) [][]byte {
+		return [][]byte{
+			[]byte("X-Accel-Buffering: no"),
+			[]byte("Access-Control-Allow-Origin: *"),
+		}
+	}).(*eventSource)
+	defer es.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &countingConn{Conn: server}
+	req := httptest.NewRequest("GET", "/", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := newConsumer(hijackableRecorder{httptest.NewRecorder(), conn}, req, es, make(http.Header))
+		if err != nil {
+			b.Fatal(err)
+		}
+		close(c.in)
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&conn.writes))/float64(b.N), "writes/op")
+}
+
+// TestMessageOrdering checks the ordering contract: messages from every
+// producer reach a consumer in the order they were sent. Messages may be
+// dropped when the consumer buffer overflows, which shows up as a gap in
+// the sequence, but they are never reordered.
+func TestMessageOrdering(t *testing.T) {
+	t.Run("DefaultBuffer", func(t *testing.T) {
+		testMessageOrdering(t, 0)
+	})
+	t.Run("LargeBuffer", func(t *testing.T) {
+		testMessageOrdering(t, 1000)
+	})
+}
+
+// testMessageOrdering sends sequence-numbered messages from several
+// producers to a single consumer. If bufferSize is big enough for all the
+// messages, none may be dropped.
+func testMessageOrdering(t *testing.T, bufferSize int) {
+	const producers = 4
+	const messages = 200
+
+	connected := make(chan ConsumerID, 1)
+	settings := DefaultSettings()
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		connected <- id
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	id := <-connected
+	if bufferSize > 0 {
+		if err := e.eventSource.ResizeConsumerBuffer(id, bufferSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for n := 0; n < messages; n++ {
+				e.eventSource.SendEventMessage(fmt.Sprintf("%d:%d", p, n), "", "")
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	var received []byte
+	resp := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := conn.Read(resp)
+		received = append(received, resp[:n]...)
+		if err != nil {
+			break
+		}
+	}
+
+	last := make([]int, producers)
+	for p := range last {
+		last[p] = -1
+	}
+	total := 0
+	for _, frame := range strings.Split(string(received), "\n\n") {
+		if !strings.HasPrefix(frame, "data: ") {
+			continue
+		}
+		var p, n int
+		if _, err := fmt.Sscanf(frame, "data: %d:%d", &p, &n); err != nil {
+			t.Fatalf("malformed frame %q: %v", frame, err)
+		}
+		if n <= last[p] {
+			t.Fatalf("producer %d: message %d received after message %d", p, n, last[p])
+		}
+		if n != last[p]+1 {
+			t.Logf("producer %d: messages %d-%d dropped", p, last[p]+1, n-1)
+		}
+		last[p] = n
+		total++
+	}
+	t.Logf("received %d of %d messages", total, producers*messages)
+	if total == 0 {
+		t.Fatal("no messages received")
+	}
+	if bufferSize >= producers*messages && total != producers*messages {
+		t.Fatal("messages were dropped")
+	}
+}
+
+func TestDataFieldName(t *testing.T) {
+	settings := DefaultSettings()
+	settings.DataFieldName = "payload"
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("send message 'test\ntest2'")
+	e.eventSource.SendEventMessage("test\ntest2", "", "1")
+	expectResponse(t, conn, "id: 1\npayload: test\npayload: test2\n\n")
+
+	for _, name := range []string{"pay:load", "pay\nload", "pay\rload"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for invalid data field name %q", name)
+				}
+			}()
+			settings := DefaultSettings()
+			settings.DataFieldName = name
+			New(settings, nil).Close()
+		}()
+	}
+}
+
+func TestSendEventMessageToLatest(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	if err := e.eventSource.SendEventMessageToLatest("test", "", ""); err != ErrConsumerNotFound {
+		t.Errorf("expected ErrConsumerNotFound, got %v", err)
+	}
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn2, _ := startEventStream(t, e)
+	defer conn2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Log("send message 'latest' to the latest connection")
+	if err := e.eventSource.SendEventMessageToLatest("latest", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	e.eventSource.SendEventMessage("test", "", "")
+	expectResponse(t, conn2, "data: latest\n\ndata: test\n\n")
+	time.Sleep(100 * time.Millisecond)
+	if resp := string(read(t, conn)); !strings.HasPrefix(resp, "data: test\n\n") {
+		t.Errorf("expected only message 'test', got:\n%s", resp)
+	}
+}
+
+func TestSuppressDuplicateFrames(t *testing.T) {
+	settings := DefaultSettings()
+	settings.SuppressDuplicateFrames = true
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("send message 'test' twice")
+	e.eventSource.SendEventMessage("test", "", "1")
+	e.eventSource.SendEventMessage("test", "", "1")
+	t.Log("send heartbeat twice")
+	e.eventSource.Heartbeat()
+	e.eventSource.Heartbeat()
+	t.Log("send message 'test' with other id")
+	e.eventSource.SendEventMessage("test", "", "2")
+	e.eventSource.SendEventMessage("test", "", "1")
+
+	time.Sleep(100 * time.Millisecond)
+	expected := "id: 1\ndata: test\n\n: heartbeat\n\n: heartbeat\n\nid: 2\ndata: test\n\nid: 1\ndata: test\n\n"
+	if resp := string(bytes.TrimRight(read(t, conn), "\x00")); resp != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, resp)
+	}
+}
+
+func TestConnectionChurnDuringBroadcast(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				e.eventSource.SendEventMessage("test", "", "")
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		conn, _ := startEventStream(t, e)
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+
+	close(done)
+	<-stopped
+
+	// dead connections fail on write at the latest
+	for i := 0; i < 3; i++ {
+		e.eventSource.Heartbeat()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if ccount := e.eventSource.ConsumersCount(); ccount != 0 {
+		t.Errorf("Expected 0 customers but got %d", ccount)
+	}
+	if goroutines := e.eventSource.Stats().Goroutines; goroutines != 0 {
+		t.Errorf("Expected 0 consumer goroutines but got %d", goroutines)
+	}
+}
+
+// TestWatchClientClose checks that a client going away is noticed with
+// the default settings, without waiting for a failed write.
+func TestWatchClientClose(t *testing.T) {
+	disconnected := make(chan error, 1)
+	settings := DefaultSettings()
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		disconnected <- err
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	conn2, _ := startEventStream(t, e)
+	defer conn2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Log("close connection without sending messages")
+	conn.Close()
+
+	select {
+	case err := <-disconnected:
+		if err != ErrClientClosed {
+			t.Errorf("expected ErrClientClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("consumer wasn't disconnected")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if ccount := e.eventSource.ConsumersCount(); ccount != 1 {
+		t.Fatalf("Expected 1 customer but got %d", ccount)
+	}
+
+	t.Log("send message 'test' to remaining connection")
+	e.eventSource.SendEventMessage("test", "", "")
+	expectResponse(t, conn2, "data: test\n\n")
+}
+
+func TestAttachConn(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	t.Log("attach connection without headers")
+	if _, err := e.eventSource.AttachConn(server); err != nil {
+		t.Fatal(err)
+	}
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+
+	t.Log("attach connection with headers")
+	go e.eventSource.AttachConn(server2, WithResponseHeaders(nil))
+	resp := read(t, client2)
+	if !strings.HasPrefix(string(resp), "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n") {
+		t.Errorf("expected response headers, got:\n%s", resp)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if ccount := e.eventSource.ConsumersCount(); ccount != 2 {
+		t.Fatalf("Expected 2 customers but got %d", ccount)
+	}
+
+	t.Log("send message 'test'")
+	e.eventSource.SendEventMessage("test", "", "1")
+	expected := "id: 1\ndata: test\n\n"
+	if resp := string(bytes.TrimRight(read(t, client), "\x00")); resp != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, resp)
+	}
+	expectResponse(t, client2, expected)
+}
+
+func TestSetConsumerFilter(t *testing.T) {
+	connected := make(chan ConsumerID, 2)
+	settings := DefaultSettings()
+	settings.FilterChangedEvent = "filter-changed"
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		connected <- id
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	id := <-connected
+	conn2, _ := startEventStream(t, e)
+	defer conn2.Close()
+	<-connected
+
+	if err := e.eventSource.SetConsumerFilter(id+2, nil); err != ErrConsumerNotFound {
+		t.Errorf("expected ErrConsumerNotFound, got %v", err)
+	}
+
+	t.Log("send messages before changing filter")
+	e.eventSource.SendEventMessage("1", "state", "")
+	e.eventSource.SendEventMessage("2", "metric", "")
+	if err := e.eventSource.SetConsumerFilter(id, func(event, id string) bool {
+		return event == "state"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("send messages after changing filter")
+	e.eventSource.SendEventMessage("3", "state", "")
+	e.eventSource.SendEventMessage("4", "metric", "")
+	// heartbeats are written before queued messages
+	time.Sleep(50 * time.Millisecond)
+	e.eventSource.Heartbeat()
+
+	time.Sleep(100 * time.Millisecond)
+	expected := "event: state\ndata: 1\n\n" +
+		"event: metric\ndata: 2\n\n" +
+		"event: filter-changed\ndata: \n\n" +
+		"event: state\ndata: 3\n\n" +
+		": heartbeat\n\n"
+	if resp := string(bytes.TrimRight(read(t, conn), "\x00")); resp != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, resp)
+	}
+	expected = "event: state\ndata: 1\n\n" +
+		"event: metric\ndata: 2\n\n" +
+		"event: state\ndata: 3\n\n" +
+		"event: metric\ndata: 4\n\n" +
+		": heartbeat\n\n"
+	if resp := string(bytes.TrimRight(read(t, conn2), "\x00")); resp != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, resp)
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	e := setup(t)
+	defer e.server.Close()
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	t.Log("close with timeout")
+	if err := e.eventSource.CloseWithTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("close wedged control loop")
+	unblock := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	settings := DefaultSettings()
+	settings.OnBroadcast = func(ctx context.Context, info BroadcastInfo) {
+		select {
+		case blocked <- struct{}{}:
+		default:
+		}
+		<-unblock
+	}
+	e = setupWithCustomSettings(t, settings)
+	defer e.server.Close()
+
+	conn, _ = startEventStream(t, e)
+	defer conn.Close()
+	e.eventSource.SendEventMessage("blocking", "", "")
+	<-blocked
+
+	start := time.Now()
+	if err := e.eventSource.CloseWithTimeout(100 * time.Millisecond); err != ErrCloseTimeout {
+		t.Fatalf("expected ErrCloseTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout fired after %v", elapsed)
+	}
+	// the connection is closed although the control goroutine is blocked
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing finishes once the callback returns
+	close(unblock)
+	done := make(chan struct{})
+	go func() {
+		e.eventSource.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("closing didn't finish after the callback returned")
+	}
+	if n := e.eventSource.ConsumersCount(); n != 0 {
+		t.Errorf("expected no consumers, got %d", n)
+	}
+}
+
+func TestCloseWithTimeoutHTTP2(t *testing.T) {
+	unblock := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	settings := DefaultSettings()
+	settings.Gzip = true
+	settings.OnBroadcast = func(ctx context.Context, info BroadcastInfo) {
+		select {
+		case blocked <- struct{}{}:
+		default:
+		}
+		<-unblock
+	}
+	es := New(settings, nil)
+	server := httptest.NewUnstartedServer(es)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	defer es.Close()
+	defer close(unblock)
+
+	// the client asks for gzip and decompresses transparently
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for es.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	es.SendEventMessage("blocking", "", "")
+	<-blocked
+
+	if err := es.CloseWithTimeout(100 * time.Millisecond); err != ErrCloseTimeout {
+		t.Fatalf("expected ErrCloseTimeout, got %v", err)
+	}
+	// the consumer goroutine ends the stream itself
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "data: blocking\n\n" {
+		t.Errorf("expected the event before the end of the stream, got %q", body)
+	}
+}
+
+func TestWriteLatencyStats(t *testing.T) {
+	var h latencyHistogram
+	for i := 0; i < 90; i++ {
+		h.observe(time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.observe(10 * time.Millisecond)
+	}
+	h.observe(100 * time.Millisecond)
+
+	inRange := func(name string, got, min time.Duration) {
+		if got < min || got > 2*min {
+			t.Errorf("expected %s in [%v, %v], got %v", name, min, 2*min, got)
+		}
+	}
+	ls := h.snapshot(false)
+	if ls.Count != 100 {
+		t.Errorf("expected 100 observations, got %d", ls.Count)
+	}
+	inRange("p50", ls.P50, time.Millisecond)
+	inRange("p95", ls.P95, 10*time.Millisecond)
+	inRange("p99", ls.P99, 10*time.Millisecond)
+
+	if ls = h.snapshot(true); ls.Count != 100 {
+		t.Errorf("expected 100 observations, got %d", ls.Count)
+	}
+	if ls = h.snapshot(false); ls.Count != 0 || ls.P99 != 0 {
+		t.Errorf("expected no observations after reset, got %+v", ls)
+	}
+
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	e.eventSource.SendEventMessage("test", "", "")
+	expectResponse(t, conn, "data: test\n\n")
+	if ls := e.eventSource.Stats().WriteLatency; ls.Count != 1 || ls.P50 <= 0 {
+		t.Errorf("expected 1 write latency observation, got %+v", ls)
+	}
+
+	// Stats doesn't reset, so other readers keep their observations
+	if ls := e.eventSource.Stats().WriteLatency; ls.Count != 1 {
+		t.Errorf("expected 1 write latency observation on the second read, got %+v", ls)
+	}
+	if ls := e.eventSource.StatsAndReset().WriteLatency; ls.Count != 1 {
+		t.Errorf("expected 1 write latency observation before reset, got %+v", ls)
+	}
+	if ls := e.eventSource.Stats().WriteLatency; ls.Count != 0 {
+		t.Errorf("expected no write latency observations after reset, got %+v", ls)
+	}
+}
+
+// bufferConn records writes in a buffer, or fails them with err.
+type bufferConn struct {
+	net.Conn
+	bytes.Buffer
+	err error
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Buffer.Write(b)
+}
+
+func (c *bufferConn) Read(b []byte) (int, error) {
+	return c.Buffer.Read(b)
+}
+
+func TestSynchronous(t *testing.T) {
+	es := NewSynchronous(nil, nil)
+	defer es.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	good := &bufferConn{Conn: server}
+	bad := &bufferConn{Conn: server}
+	req := httptest.NewRequest("GET", "/", nil)
+	es.ServeHTTP(hijackableRecorder{httptest.NewRecorder(), good}, req)
+	es.ServeHTTP(hijackableRecorder{httptest.NewRecorder(), bad}, req)
+	if es.ConsumersCount() != 2 {
+		t.Fatalf("expected 2 consumers, got %d", es.ConsumersCount())
+	}
+	if !strings.HasPrefix(good.String(), "HTTP/1.1 200 OK\r\n") {
+		t.Fatalf("unexpected response headers %q", good.String())
+	}
+	good.Reset()
+
+	if err := es.SendEventMessage("hello", "greet", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if good.String() != "id: 1\nevent: greet\ndata: hello\n\n" {
+		t.Fatalf("unexpected frame %q", good.String())
+	}
+	good.Reset()
+
+	errBroken := fmt.Errorf("broken pipe")
+	bad.err = errBroken
+	if err := es.SendEventMessage("again", "", ""); err != errBroken {
+		t.Fatalf("expected %v, got %v", errBroken, err)
+	}
+	if good.String() != "data: again\n\n" {
+		t.Fatalf("unexpected frame %q", good.String())
+	}
+	if es.ConsumersCount() != 1 {
+		t.Fatalf("expected the failing consumer to be removed, got %d consumers", es.ConsumersCount())
+	}
+
+	es.Close()
+	if err := es.SendRetryMessage(time.Second); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSynchronousResponse(t *testing.T) {
+	es := NewSynchronous(nil, nil)
+	defer es.Close()
+
+	// a recorder can't be hijacked, like HTTP/2 responses
+	rec := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	served := make(chan bool)
+	go func() {
+		es.ServeHTTP(rec, req)
+		close(served)
+	}()
+	for es.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := es.SendEventMessage("hello", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-served
+	if es.ConsumersCount() != 0 {
+		t.Errorf("expected the consumer to be removed, got %d consumers", es.ConsumersCount())
+	}
+	if body := rec.Body.String(); body != "data: hello\n\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestSynchronousOnConnectSends(t *testing.T) {
+	settings := DefaultSettings()
+	var es *SyncEventSource
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		if n := es.ConsumersCount(); n != 1 {
+			t.Errorf("expected the consumer to be added, got %d consumers", n)
+		}
+		if err := es.SendEventMessage("welcome", "", ""); err != nil {
+			t.Error(err)
+		}
+	}
+	es = NewSynchronous(settings, nil)
+	defer es.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &bufferConn{Conn: server}
+	es.ServeHTTP(hijackableRecorder{httptest.NewRecorder(), conn}, httptest.NewRequest("GET", "/", nil))
+	if !strings.HasSuffix(conn.String(), "\r\n\r\ndata: welcome\n\n") {
+		t.Errorf("expected the event sent by OnConnect, got %q", conn.String())
+	}
+}
+
+// ndjsonSerializer frames events as JSON lines.
+type ndjsonSerializer struct{}
+
+func (ndjsonSerializer) SerializeEvent(data, event, id string) []byte {
+	return []byte(fmt.Sprintf("{\"id\":%q,\"event\":%q,\"data\":%q}\n", id, event, data))
+}
+
+func (ndjsonSerializer) SerializeRetry(time.Duration) []byte { return nil }
+
+func (ndjsonSerializer) SerializeComment(string) []byte { return nil }
+
+// plainSerializer frames events as their data lines.
+type plainSerializer struct{}
+
+func (plainSerializer) SerializeEvent(data, event, id string) []byte {
+	return []byte(data + "\n")
+}
+
+func (plainSerializer) SerializeRetry(time.Duration) []byte { return nil }
+
+func (plainSerializer) SerializeComment(string) []byte { return nil }
+
+func TestNegotiateSerializer(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Serializers = map[string]Serializer{
+		"application/x-ndjson": ndjsonSerializer{},
+		"Text/Plain":           plainSerializer{},
+	}
+	es := New(settings, nil).(*eventSource)
+	defer es.Close()
+
+	for accept, expected := range map[string]string{
+		"":                                 "text/event-stream",
+		"*/*":                              "text/event-stream",
+		"application/xml":                  "text/event-stream",
+		"text/event-stream":                "text/event-stream",
+		"application/x-ndjson":             "application/x-ndjson",
+		"text/plain; charset=utf-8":        "text/plain",
+		"text/plain;q=0.5, */*;q=0.1":      "text/plain",
+		"application/x-ndjson, text/plain": "application/x-ndjson",
+		"text/plain;q=0.4, application/x-ndjson;q=0.9, text/event-stream;q=0.5": "application/x-ndjson",
+		"text/event-stream, text/plain":                                         "text/event-stream",
+		"application/x-ndjson;q=0, *;q=1":                                       "text/event-stream",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		contentType, _ := es.negotiate(req)
+		if contentType != expected {
+			t.Errorf("Accept %q: expected %q, got %q", accept, expected, contentType)
+		}
+	}
+}
+
+func TestSerializers(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Serializers = map[string]Serializer{
+		"application/x-ndjson": ndjsonSerializer{},
+		"text/plain":           plainSerializer{},
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	sse, resp := startEventStream(t, e)
+	defer sse.Close()
+	if !strings.Contains(string(resp), "Content-Type: text/event-stream\r\nVary: Accept, Accept-Encoding\r\n") {
+		t.Errorf("unexpected SSE response headers:\n%s", resp)
+	}
+	ndjson, resp := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept: application/x-ndjson\r\n\r\n")
+	defer ndjson.Close()
+	if !strings.Contains(string(resp), "Content-Type: application/x-ndjson\r\n") {
+		t.Errorf("unexpected NDJSON response headers:\n%s", resp)
+	}
+	plain, resp := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept: text/plain\r\n\r\n")
+	defer plain.Close()
+	if !strings.Contains(string(resp), "Content-Type: text/plain\r\n") {
+		t.Errorf("unexpected plain response headers:\n%s", resp)
+	}
+
+	e.eventSource.SendRetryMessage(time.Second)
+	e.eventSource.SendEventMessage("hello", "greet", "1")
+	expectResponse(t, sse, "retry: 1000\n\nid: 1\nevent: greet\ndata: hello\n\n")
+	expectResponse(t, ndjson, "{\"id\":\"1\",\"event\":\"greet\",\"data\":\"hello\"}\n")
+	expectResponse(t, plain, "hello\n")
+}
+
+func TestReorderBuffer(t *testing.T) {
+	ids := func(messages []message) string {
+		var out []string
+		for _, m := range messages {
+			em := m.(*eventMessage)
+			if em.event == "gap" {
+				out = append(out, "gap "+em.data)
+			} else {
+				out = append(out, em.id)
+			}
+		}
+		return strings.Join(out, ",")
+	}
+
+	r := newReorderBuffer(time.Second, "gap")
+	now := time.Now()
+	push := func(id uint64) string {
+		return ids(r.push(&eventMessage{id: strconv.FormatUint(id, 10)}, id, now))
+	}
+
+	// the first event is held for the window since lower ids may follow
+	if released := push(3); released != "" {
+		t.Fatalf("expected nothing released, got %q", released)
+	}
+	if released := push(2); released != "" {
+		t.Fatalf("expected nothing released, got %q", released)
+	}
+	now = now.Add(time.Second)
+	if released := ids(r.expired(now)); released != "2,3" {
+		t.Fatalf("expected 2,3 released, got %q", released)
+	}
+
+	// out of order ids are released once the lower ones arrive
+	if released := push(6); released != "" {
+		t.Fatalf("expected nothing released, got %q", released)
+	}
+	if released := push(5); released != "" {
+		t.Fatalf("expected nothing released, got %q", released)
+	}
+	if released := push(4); released != "4,5,6" {
+		t.Fatalf("expected 4,5,6 released, got %q", released)
+	}
+
+	// ids missing past the window are marked by a gap event
+	push(10)
+	push(8)
+	now = now.Add(500 * time.Millisecond)
+	if released := ids(r.expired(now)); released != "" {
+		t.Fatalf("expected nothing released before the window, got %q", released)
+	}
+	if r.expiry() == nil {
+		t.Fatal("expected an expiry timer for held events")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if released := ids(r.expired(now)); released != "gap 7,8,gap 9,10" {
+		t.Fatalf("expected gaps and 8,10 released, got %q", released)
+	}
+	if r.expiry() != nil {
+		t.Fatal("expected no expiry timer without held events")
+	}
+
+	// late ids are released right away
+	if released := push(9); released != "9" {
+		t.Fatalf("expected 9 released, got %q", released)
+	}
+
+	push(13)
+	if released := ids(r.flush()); released != "gap 11-12,13" {
+		t.Fatalf("expected gap and 13 flushed, got %q", released)
+	}
+}
+
+func TestReorderWindow(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ReorderWindow = 50 * time.Millisecond
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	e.eventSource.SendEventMessage("b", "", "2")
+	e.eventSource.SendEventMessage("a", "", "1")
+	e.eventSource.SendEventMessage("c", "", "3")
+	e.eventSource.SendEventMessage("plain", "", "")
+	expectResponse(t, conn, "data: plain\n\nid: 1\ndata: a\n\nid: 2\ndata: b\n\nid: 3\ndata: c\n\n")
+}
+
+// TestDefaultEventNames checks that the event names of settings built
+// without DefaultSettings fall back to the defaults, so the events aren't
+// sent as plain messages.
+func TestDefaultEventNames(t *testing.T) {
+	es := New(&Settings{ReorderWindow: time.Second}, nil).(*eventSource)
+	defer es.Close()
+
+	if es.reorder.gapEvent != "gap" {
+		t.Errorf("expected the gap event %q, got %q", "gap", es.reorder.gapEvent)
+	}
+	if es.errorEvent != "error" {
+		t.Errorf("expected the error event %q, got %q", "error", es.errorEvent)
+	}
+	if es.farewellEvent != "farewell" {
+		t.Errorf("expected the farewell event %q, got %q", "farewell", es.farewellEvent)
+	}
+}
+
+func TestRetire(t *testing.T) {
+	e := setup(t)
+	defer e.server.Close()
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	e.eventSource.Retire("this feed has moved")
+	expectResponse(t, conn, "event: farewell\ndata: this feed has moved\n\n")
+
+	// retiring again doesn't close the event source twice
+	e.eventSource.Retire("again")
+
+	resp, err := http.Get(e.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("expected status %d, got %d", http.StatusGone, resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "this feed has moved\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestSendRetryMessageWhere(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConsumerMetadata = func(req *http.Request) map[string]string {
+		return map[string]string{"tier": req.URL.Query().Get("tier")}
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	free, _ := startEventStreamURI(t, e, "/?tier=free")
+	defer free.Close()
+	premium, _ := startEventStreamURI(t, e, "/?tier=premium")
+	defer premium.Close()
+
+	e.eventSource.SendRetryMessageWhere(map[string]string{"tier": "free"}, 30*time.Second)
+	e.eventSource.SendEventMessage("next", "", "")
+	expectResponse(t, free, "retry: 30000\n\ndata: next\n\n")
+
+	time.Sleep(100 * time.Millisecond)
+	resp := read(t, premium)
+	if !strings.HasPrefix(string(resp), "data: next\n\n") {
+		t.Errorf("expected only the event for the premium consumer, got:\n%s", resp)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	if events, _ := h.After("1"); events != nil {
+		t.Fatalf("expected nothing after an unknown id, got %d events", len(events))
+	}
+	for i := 1; i <= 5; i++ {
+		h.Append(Event{ID: strconv.Itoa(i)})
+	}
+
+	for id, expected := range map[string]string{
+		"1": "-",
+		"2": "-",
+		"3": "4,5",
+		"4": "5",
+		"5": "",
+	} {
+		events, err := h.After(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := "-"
+		if events != nil {
+			ids := make([]string, len(events))
+			for i, e := range events {
+				ids[i] = e.ID
+			}
+			got = strings.Join(ids, ",")
+		}
+		if got != expected {
+			t.Errorf("after %s: expected %q, got %q", id, expected, got)
+		}
+	}
+}
+
+func TestLastEventIDReplay(t *testing.T) {
+	settings := DefaultSettings()
+	settings.HistorySize = 3
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	for i := 1; i <= 4; i++ {
+		e.eventSource.SendEventMessage(fmt.Sprintf("event %d", i), "", strconv.Itoa(i))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	conn, resp := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 2\r\n\r\n")
+	defer conn.Close()
+	// the replay may come along with the response headers
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	rest := make([]byte, 1024)
+	n, _ := conn.Read(rest)
+	conn.SetReadDeadline(time.Time{})
+	resp = append(bytes.TrimRight(resp, "\x00"), rest[:n]...)
+	if !strings.HasSuffix(string(resp), "\r\n\r\nid: 3\ndata: event 3\n\nid: 4\ndata: event 4\n\n") {
+		t.Errorf("expected events 3 and 4 replayed, got:\n%s", resp)
+	}
+
+	e.eventSource.SendEventMessage("event 5", "", "5")
+	expectResponse(t, conn, "id: 5\ndata: event 5\n\n")
+}
+
+// sliceStore is an EventStore surviving event sources.
+type sliceStore struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (s *sliceStore) Append(e Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *sliceStore) After(id string) ([]Event, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, e := range s.events {
+		if e.ID == id {
+			return append([]Event(nil), s.events[i+1:]...), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *sliceStore) LastEventID() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.events) == 0 {
+		return "", nil
+	}
+	return s.events[len(s.events)-1].ID, nil
+}
+
+func TestEventStore(t *testing.T) {
+	store := new(sliceStore)
+	for i := 0; i <= 20; i++ {
+		store.Append(Event{ID: strconv.Itoa(i), Data: "stored"})
+	}
+	settings := DefaultSettings()
+	settings.EventStore = store
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, resp := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 0\r\n\r\n")
+	defer conn.Close()
+	e.eventSource.SendEventMessage("live", "", "21")
+
+	// more events are replayed than fit into a consumer buffer by default
+	var expected strings.Builder
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&expected, "id: %d\ndata: stored\n\n", i)
+	}
+	expected.WriteString("id: 21\ndata: live\n\n")
+	got := string(bytes.TrimRight(resp, "\x00"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for !strings.HasSuffix(got, expected.String()) {
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("expected replayed and live events, got:\n%s", got)
+		}
+		got += string(buf[:n])
+	}
+
+	if events, _ := store.After("20"); len(events) != 1 || events[0].Data != "live" {
+		t.Errorf("expected the live event stored, got %v", events)
+	}
+}
+
+func TestSendEventMessageToChannel(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	orders, _ := startEventStreamURI(t, e, "/?channels=orders,alerts")
+	defer orders.Close()
+	alerts, _ := startEventStreamURI(t, e, "/?channels=alerts")
+	defer alerts.Close()
+
+	e.eventSource.SendEventMessageToChannel("order 1", "order", "", "orders")
+	e.eventSource.SendEventMessageToChannel("disk full", "alert", "", "alerts")
+	expectResponse(t, orders, "event: order\ndata: order 1\n\nevent: alert\ndata: disk full\n\n")
+
+	time.Sleep(100 * time.Millisecond)
+	resp := read(t, alerts)
+	if !strings.HasPrefix(string(resp), "event: alert\ndata: disk full\n\n\x00") {
+		t.Errorf("expected only the alert for the alerts subscriber, got:\n%s", resp)
+	}
+}
+
+func TestSendEventMessageTo(t *testing.T) {
+	ids := make(chan ConsumerID, 2)
+	settings := DefaultSettings()
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		ids <- id
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	first, _ := startEventStream(t, e)
+	defer first.Close()
+	firstID := <-ids
+	second, _ := startEventStream(t, e)
+	defer second.Close()
+	<-ids
+
+	if err := e.eventSource.SendEventMessageTo(firstID, "for you", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	e.eventSource.SendEventMessage("for all", "", "")
+	expectResponse(t, first, "data: for you\n\ndata: for all\n\n")
+
+	time.Sleep(100 * time.Millisecond)
+	resp := read(t, second)
+	if !strings.HasPrefix(string(resp), "data: for all\n\n\x00") {
+		t.Errorf("expected only the broadcast for the second consumer, got:\n%s", resp)
+	}
+
+	if err := e.eventSource.SendEventMessageTo(ConsumerID(1000), "lost", "", ""); err != ErrConsumerNotFound {
+		t.Errorf("expected ErrConsumerNotFound, got %v", err)
+	}
+}
+
+func TestOnConnectSnapshot(t *testing.T) {
+	var es EventSource
+	disconnected := make(chan error, 1)
+	settings := DefaultSettings()
+	settings.IdleTimeout = 300 * time.Millisecond
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		if err := es.SendEventMessageTo(id, "snapshot", "", ""); err != nil {
+			t.Errorf("can't send the snapshot: %v", err)
+		}
+	}
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		disconnected <- err
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+	es = e.eventSource
+
+	conn, resp := startEventStream(t, e)
+	defer conn.Close()
+	e.eventSource.SendEventMessage("update", "", "")
+	if !strings.Contains(string(resp), "\r\n\r\ndata: snapshot\n\n") {
+		expectResponse(t, conn, "data: snapshot\n\ndata: update\n\n")
+	} else {
+		expectResponse(t, conn, "data: update\n\n")
+	}
+
+	select {
+	case err := <-disconnected:
+		if err != ErrIdleTimeout {
+			t.Errorf("expected ErrIdleTimeout as the disconnect reason, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnDisconnect wasn't called")
+	}
+}
+
+func TestConsumerFilter(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConsumerFilter = func(req *http.Request, e Event) bool {
+		return strings.HasPrefix(e.Data, req.URL.Query().Get("tenant")+":")
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	acme, _ := startEventStreamURI(t, e, "/?tenant=acme")
+	defer acme.Close()
+	globex, _ := startEventStreamURI(t, e, "/?tenant=globex")
+	defer globex.Close()
+
+	e.eventSource.SendEventMessage("globex:invoice", "", "")
+	e.eventSource.SendEventMessage("acme:order", "", "")
+	e.eventSource.Heartbeat()
+	expectResponse(t, acme, "data: acme:order\n\n: heartbeat\n\n")
+	expectResponse(t, globex, "data: globex:invoice\n\n: heartbeat\n\n")
+}
+
+func TestKeepAliveInterval(t *testing.T) {
+	settings := DefaultSettings()
+	settings.KeepAliveInterval = 50 * time.Millisecond
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	e.eventSource.SendEventMessage("event", "", "")
+	expectResponse(t, conn, "data: event\n\n: keepalive\n\n")
+}
+
+func TestShutdown(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ShutdownEvent = "shutdown"
+	e := setupWithCustomSettings(t, settings)
+	defer e.server.Close()
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	for i := 0; i < 5; i++ {
+		e.eventSource.SendEventMessage(strconv.Itoa(i), "", "")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := e.eventSource.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything has been written before Shutdown returned
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got, _ := io.ReadAll(conn)
+	expected := "data: 0\n\ndata: 1\n\ndata: 2\n\ndata: 3\n\ndata: 4\n\nevent: shutdown\ndata: \n\n"
+	if !strings.HasSuffix(string(got), expected) {
+		t.Errorf("expected queued events and the shutdown event, got:\n%s", got)
+	}
+
+	resp, err := http.Get(e.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d after shutdown, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	if err := e.eventSource.Shutdown(ctx); err != ErrClosed {
+		t.Errorf("expected ErrClosed shutting down twice, got %v", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	e := setup(t)
+	defer e.server.Close()
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	e.eventSource.Close()
+	e.eventSource.Close()
+	if count := e.eventSource.ConsumersCount(); count != 0 {
+		t.Errorf("expected no consumers after closing, got %d", count)
+	}
+
+	if err := e.eventSource.SendEventMessage("late", "", ""); err != ErrClosed {
+		t.Errorf("SendEventMessage: expected ErrClosed, got %v", err)
+	}
+	if err := e.eventSource.SendRetryMessage(time.Second); err != ErrClosed {
+		t.Errorf("SendRetryMessage: expected ErrClosed, got %v", err)
+	}
+	if err := e.eventSource.SendEventMessageToLatest("late", "", ""); err != ErrClosed {
+		t.Errorf("SendEventMessageToLatest: expected ErrClosed, got %v", err)
+	}
+	if err := e.eventSource.SendEventMessageTimeout("late", "", "", time.Second); err != ErrClosed {
+		t.Errorf("SendEventMessageTimeout: expected ErrClosed, got %v", err)
+	}
+	if err := e.eventSource.ResizeConsumerBuffer(1, 10); err != ErrClosed {
+		t.Errorf("ResizeConsumerBuffer: expected ErrClosed, got %v", err)
+	}
+	e.eventSource.Heartbeat()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	if _, err := e.eventSource.AttachConn(server); err != ErrClosed {
+		t.Errorf("AttachConn: expected ErrClosed, got %v", err)
+	}
+
+	resp, err := http.Get(e.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d after closing, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestSendEventMessageCounted(t *testing.T) {
+	es := New(nil, nil)
+
+	if delivered, dropped, err := es.SendEventMessageCounted("nobody", "", ""); delivered != 0 || dropped != 0 || err != nil {
+		t.Errorf("expected nothing delivered without consumers, got %d, %d, %v", delivered, dropped, err)
+	}
+
+	// nobody reads from the client side, so the consumer buffer fills up
+	client, server := net.Pipe()
+	defer client.Close()
+	if _, err := es.AttachConn(server); err != nil {
+		t.Fatal(err)
+	}
+
+	totalDropped := 0
+	for i := 0; i < 20; i++ {
+		delivered, dropped, err := es.SendEventMessageCounted(strconv.Itoa(i), "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delivered+dropped != 1 {
+			t.Fatalf("expected the message counted once, got %d delivered and %d dropped", delivered, dropped)
+		}
+		totalDropped += dropped
+	}
+	if totalDropped < 9 {
+		t.Errorf("expected at least 9 messages dropped, got %d", totalDropped)
+	}
+
+	// control messages have their own queue
+	if delivered, _, err := es.SendRetryMessageCounted(time.Second); delivered != 1 || err != nil {
+		t.Errorf("expected the retry message delivered, got %d, %v", delivered, err)
+	}
+
+	es.Close()
+	if _, _, err := es.SendEventMessageCounted("late", "", ""); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	es := New(nil, func(*http.Request) [][]byte {
+		return [][]byte{[]byte("X-Accel-Buffering: no")}
+	})
+	server := httptest.NewUnstartedServer(es)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	defer es.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+	}
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("unexpected Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("X-Accel-Buffering") != "no" {
+		t.Errorf("expected the custom header, got %v", resp.Header)
+	}
+
+	// the headers are flushed before the consumer is registered
+	for es.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	es.SendEventMessage("over h2", "", "1")
+	expected := "id: 1\ndata: over h2\n\n"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Errorf("expected %q, got %q", expected, buf)
+	}
+}
+
+func TestHTTP2ClientGone(t *testing.T) {
+	disconnected := make(chan error, 1)
+	settings := DefaultSettings()
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		disconnected <- err
+	}
+	es := New(settings, nil)
+	server := httptest.NewUnstartedServer(es)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	defer es.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for es.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// resets the stream without any write to the consumer
+	cancel()
+	select {
+	case err := <-disconnected:
+		if err != ErrClientClosed {
+			t.Errorf("expected ErrClientClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the consumer wasn't removed after the client went away")
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, err := net.Dial("tcp", strings.Replace(e.server.URL, "http://", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Close {
+		t.Error("expected the response to be delimited by closing the connection")
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) != 0 {
+		t.Errorf("expected no body length, got Content-Length %d and Transfer-Encoding %v", resp.ContentLength, resp.TransferEncoding)
+	}
+
+	for e.eventSource.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	e.eventSource.SendEventMessage("framed", "", "")
+	e.eventSource.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "data: framed\n\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	e := setupWithHeaders(t, [][]byte{[]byte("Access-Control-Allow-Origin: *")})
+	defer teardown(t, e)
+
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		req, _ := http.NewRequest(method, e.server.URL, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s: expected status %d, got %d", method, http.StatusMethodNotAllowed, resp.StatusCode)
+		}
+		if resp.Header.Get("Allow") != "GET, OPTIONS" {
+			t.Errorf("%s: unexpected Allow header %q", method, resp.Header.Get("Allow"))
+		}
+	}
+
+	req, _ := http.NewRequest("OPTIONS", e.server.URL, nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "Last-Event-ID")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("OPTIONS: expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	for name, expected := range map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET",
+		"Access-Control-Allow-Headers": "Last-Event-ID",
+	} {
+		if got := resp.Header.Get(name); got != expected {
+			t.Errorf("OPTIONS: expected %s %q, got %q", name, expected, got)
+		}
+	}
+	if count := e.eventSource.ConsumersCount(); count != 0 {
+		t.Errorf("expected no consumers, got %d", count)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	settings := DefaultSettings()
+	settings.CORS = &CORS{
+		AllowedOrigins:   []string{"https://example.com"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	for origin, expected := range map[string]map[string]string{
+		"https://example.com": {
+			"Access-Control-Allow-Origin":      "https://example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Max-Age":           "600",
+			"Vary":                             "Origin",
+		},
+		"https://evil.com": {
+			"Access-Control-Allow-Origin":      "",
+			"Access-Control-Allow-Credentials": "",
+			"Vary":                             "Origin",
+		},
+	} {
+		req, _ := http.NewRequest("OPTIONS", e.server.URL, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for name, value := range expected {
+			if got := resp.Header.Get(name); got != value {
+				t.Errorf("%s: expected %s %q, got %q", origin, name, value, got)
+			}
+		}
+	}
+
+	conn, err := net.Dial("tcp", strings.Replace(e.server.URL, "http://", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Errorf("expected the origin to be echoed, got %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Max-Age"); got != "" {
+		t.Errorf("expected no Access-Control-Max-Age with streams, got %q", got)
+	}
+
+	any := &CORS{AllowedOrigins: []string{"*"}}
+	if got := any.allowedOrigin("https://example.com"); got != "*" {
+		t.Errorf("expected any origin to be allowed with *, got %q", got)
+	}
+	any.AllowCredentials = true
+	if got := any.allowedOrigin("https://example.com"); got != "https://example.com" {
+		t.Errorf("expected the origin to be echoed with credentials, got %q", got)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Authorize = func(req *http.Request) (int, error) {
+		switch req.Header.Get("Authorization") {
+		case "Bearer valid":
+			return 0, nil
+		case "":
+			return http.StatusUnauthorized, errors.New("no token")
+		}
+		return 0, errors.New("invalid token")
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	for token, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer forged": http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest("GET", e.server.URL, nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%q: expected status %d, got %d", token, expected, resp.StatusCode)
+		}
+	}
+	if count := e.eventSource.ConsumersCount(); count != 0 {
+		t.Errorf("expected no consumers, got %d", count)
+	}
+
+	conn, err := net.Dial("tcp", strings.Replace(e.server.URL, "http://", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer valid")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Headers = func(req *http.Request) (int, http.Header) {
+		if req.URL.Query().Get("done") != "" {
+			return http.StatusNoContent, nil
+		}
+		return 0, http.Header{"x-accel-buffering": {"no"}}
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	resp, err := http.Get(e.server.URL + "?done=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	conn, head := startEventStream(t, e)
+	defer conn.Close()
+	if !strings.Contains(string(head), "HTTP/1.1 200 OK\r\n") {
+		t.Error("the response has no HTTP status")
+	}
+	if !strings.Contains(string(head), "X-Accel-Buffering: no\r\n") {
+		t.Errorf("the response has no canonicalized X-Accel-Buffering header: %q", head)
+	}
+}
+
+func TestStreamingHeaders(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Headers = func(*http.Request) (int, http.Header) {
+		return 0, http.Header{"Cache-Control": {"no-store"}}
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, resp := startEventStream(t, e)
+	defer conn.Close()
+	if !strings.Contains(string(resp), "X-Accel-Buffering: no\r\n") {
+		t.Error("the response has no X-Accel-Buffering header with value 'no'")
+	}
+	if !strings.Contains(string(resp), "Cache-Control: no-store\r\n") || strings.Contains(string(resp), "no-cache") {
+		t.Errorf("expected Cache-Control to be overridden, got %q", resp)
+	}
+
+	e2 := setupWithCustomSettings(t, &Settings{Timeout: time.Second})
+	defer teardown(t, e2)
+
+	conn2, resp := startEventStream(t, e2)
+	defer conn2.Close()
+	if strings.Contains(string(resp), "X-Accel-Buffering") || strings.Contains(string(resp), "Cache-Control") {
+		t.Errorf("expected no streaming headers, got %q", resp)
+	}
+}
+
+func TestSendComment(t *testing.T) {
+	ids := make(chan ConsumerID, 2)
+	settings := DefaultSettings()
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		ids <- id
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	first, _ := startEventStream(t, e)
+	defer first.Close()
+	firstID := <-ids
+	second, _ := startEventStream(t, e)
+	defer second.Close()
+	<-ids
+
+	if err := e.eventSource.SendCommentTo(firstID, "only you"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.eventSource.SendComment("marker\nsecond line"); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, first, ": only you\n\n: marker\n: second line\n\n")
+	expectResponse(t, second, ": marker\n: second line\n\n")
+
+	if err := e.eventSource.SendCommentTo(ConsumerID(1000), "lost"); err != ErrConsumerNotFound {
+		t.Errorf("expected ErrConsumerNotFound, got %v", err)
+	}
+}
+
+func TestSendJSON(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	payload := struct {
+		Text string `json:"text"`
+	}{"two\nlines"}
+	if err := e.eventSource.SendJSON(payload, "note", "1"); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, conn, "id: 1\nevent: note\ndata: {\"text\":\"two\\nlines\"}\n\n")
+
+	if err := e.eventSource.SendJSON(make(chan int), "", ""); err == nil {
+		t.Error("expected an encoding error")
+	}
+}
+
+func TestSend(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	err := e.eventSource.Send(Event{ID: "7", Type: "update", Data: "payload", Comment: "debug marker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, conn, ": debug marker\nid: 7\nevent: update\ndata: payload\n\n")
+}
+
+func TestSendWithRetry(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	e.eventSource.Send(Event{ID: "1", Type: "moved", Data: "bye", Retry: 5 * time.Second})
+	e.eventSource.Send(Event{Data: "clamped", Retry: time.Microsecond})
+	expectResponse(t, conn, "id: 1\nevent: moved\nretry: 5000\ndata: bye\n\nretry: 1\ndata: clamped\n\n")
+}
+
+func TestLineBreaks(t *testing.T) {
+	for _, tc := range []struct {
+		m        message
+		expected string
+	}{
+		{&eventMessage{data: "a\r\nb\rc\nd"}, "data: a\ndata: b\ndata: c\ndata: d\n"},
+		{&eventMessage{data: "a\r\n\r\nb"}, "data: a\ndata: \ndata: b\n"},
+		{&eventMessage{data: "a\n\rb"}, "data: a\ndata: \ndata: b\n"},
+		{&eventMessage{data: "end\r"}, "data: end\ndata: \n"},
+		{&eventMessage{id: "1\r\n2\r3", event: "x\ry", data: "d"}, "id: 123\nevent: xy\ndata: d\n"},
+		{&commentMessage{comment: "one\rtwo\r\nthree"}, ": one\n: two\n: three\n"},
+	} {
+		if got := string(tc.m.appendMessage(nil)); got != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, got)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Strict = true
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	if err := e.eventSource.SendEventMessage("data", "", "1\n1"); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID, got %v", err)
+	}
+	if err := e.eventSource.SendEventMessageToChannel("data", "", "1\x00", "news"); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID, got %v", err)
+	}
+	if err := e.eventSource.Send(Event{Type: "up\rdate"}); err != ErrInvalidEventName {
+		t.Errorf("expected ErrInvalidEventName, got %v", err)
+	}
+	if err := e.eventSource.SendEventMessage("data\nwith lines", "update", "2"); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, conn, "id: 2\nevent: update\ndata: data\ndata: with lines\n\n")
+}
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	consumers := make([]*consumer, 100)
+	for i := range consumers {
+		consumers[i] = &consumer{id: ConsumerID(i + 1)}
+		r.add(consumers[i])
+	}
+	r.add(consumers[0])
+	if r.len() != 100 {
+		t.Fatalf("expected 100 consumers, got %d", r.len())
+	}
+	if c := r.get(42); c != consumers[41] {
+		t.Errorf("expected consumer 42, got %v", c)
+	}
+	if c := r.latest(); c != consumers[99] {
+		t.Errorf("expected consumer 100 to be the latest, got %v", c)
+	}
+
+	if !r.remove(consumers[99]) || r.remove(consumers[99]) {
+		t.Error("expected consumer 100 to be removed once")
+	}
+	if r.remove(&consumer{id: 1}) {
+		t.Error("expected another consumer with the same ID not to be removed")
+	}
+	if c := r.latest(); c != consumers[98] {
+		t.Errorf("expected consumer 99 to be the latest, got %v", c)
+	}
+
+	seen := 0
+	r.each(func(*consumer) { seen++ })
+	if seen != 99 || r.len() != 99 {
+		t.Errorf("expected 99 consumers, saw %d and counted %d", seen, r.len())
+	}
+
+	r.clear()
+	if r.len() != 0 || r.get(1) != nil {
+		t.Error("expected no consumers after clearing")
+	}
+}
+
+func TestFanOutWorkers(t *testing.T) {
+	settings := DefaultSettings()
+	settings.FanOutWorkers = 4
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conns := make([]net.Conn, 10)
+	for i := range conns {
+		conns[i], _ = startEventStream(t, e)
+		defer conns[i].Close()
+	}
+	for e.eventSource.ConsumersCount() < len(conns) {
+		time.Sleep(time.Millisecond)
+	}
+
+	delivered, dropped, err := e.eventSource.SendEventMessageCounted("fan out", "", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != len(conns) || dropped != 0 {
+		t.Errorf("expected %d deliveries, got %d delivered and %d dropped", len(conns), delivered, dropped)
+	}
+	for _, conn := range conns {
+		expectResponse(t, conn, "id: 1\ndata: fan out\n\n")
+	}
+
+	stats := e.eventSource.Stats()
+	if len(stats.FanOut) != 4 {
+		t.Fatalf("expected stats of 4 workers, got %d", len(stats.FanOut))
+	}
+	var total uint64
+	for _, partition := range stats.FanOut {
+		total += partition.Delivered
+	}
+	if total != uint64(len(conns)) {
+		t.Errorf("expected %d deliveries in worker stats, got %d", len(conns), total)
+	}
+}
+
+// attachStuck attaches a consumer whose client doesn't read until a first
+// message is being written to it.
+func attachStuck(t *testing.T, es EventSource) (*consumer, net.Conn) {
+	client, server := net.Pipe()
+	id, err := es.AttachConn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for es.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c := es.(*eventSource).consumer(id)
+	es.SendEventMessageCounted("1", "", "")
+	for len(c.in) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return c, client
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	for policy, expected := range map[OverflowPolicy]string{
+		DropNewest: "data: 1\n\ndata: 2\n\ndata: 3\n\n",
+		DropOldest: "data: 1\n\ndata: 4\n\ndata: 5\n\n",
+	} {
+		settings := DefaultSettings()
+		settings.ConsumerBufferSize = 2
+		settings.OverflowPolicy = policy
+		es := New(settings, nil)
+
+		_, client := attachStuck(t, es)
+		for _, data := range []string{"2", "3", "4", "5"} {
+			es.SendEventMessageCounted(data, "", "")
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		resp := make([]byte, len(expected))
+		io.ReadFull(client, resp)
+		if string(resp) != expected {
+			t.Errorf("policy %d: expected %q, got %q", policy, expected, resp)
+		}
+		client.Close()
+		es.Close()
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	disconnected := make(chan error, 1)
+	settings := DefaultSettings()
+	settings.ConsumerBufferSize = 1
+	settings.OverflowPolicy = DisconnectConsumer
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		disconnected <- err
+	}
+	es := New(settings, nil)
+	defer es.Close()
+
+	_, client := attachStuck(t, es)
+	defer client.Close()
+	es.SendEventMessage("2", "", "")
+	if _, dropped, _ := es.SendEventMessageCounted("3", "", ""); dropped != 1 {
+		t.Errorf("expected the overflowing message to be dropped, got %d dropped", dropped)
+	}
+	if count := es.ConsumersCount(); count != 0 {
+		t.Errorf("expected the consumer to be removed, got %d consumers", count)
+	}
+
+	io.Copy(io.Discard, client)
+	if err := <-disconnected; err != ErrBufferOverflow {
+		t.Errorf("expected ErrBufferOverflow, got %v", err)
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConsumerBufferSize = 1
+	settings.OverflowPolicy = Block
+	settings.OverflowTimeout = 50 * time.Millisecond
+	es := New(settings, nil)
+	defer es.Close()
+
+	_, client := attachStuck(t, es)
+	defer client.Close()
+	es.SendEventMessage("2", "", "")
+
+	start := time.Now()
+	if _, dropped, _ := es.SendEventMessageCounted("3", "", ""); dropped != 1 {
+		t.Errorf("expected the message to be dropped after the timeout, got %d dropped", dropped)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected sending to block for the timeout, returned after %v", elapsed)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		read(t, client)
+	}()
+	if delivered, _, _ := es.SendEventMessageCounted("4", "", ""); delivered != 1 {
+		t.Error("expected the message to be queued once the client reads")
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	for name, configure := range map[string]func(*Settings){
+		"drops": func(s *Settings) { s.SlowConsumerDrops = 2 },
+		"lag":   func(s *Settings) { s.SlowConsumerLag = 50 * time.Millisecond },
+	} {
+		disconnected := make(chan error, 1)
+		settings := DefaultSettings()
+		settings.ConsumerBufferSize = 1
+		settings.OnDisconnect = func(id ConsumerID, err error) {
+			disconnected <- err
+		}
+		configure(settings)
+		es := New(settings, nil)
+
+		c, client := attachStuck(t, es)
+		es.SendEventMessageCounted("2", "", "")
+		time.Sleep(80 * time.Millisecond)
+		es.SendEventMessageCounted("3", "", "")
+		if es.ConsumersCount() != 0 {
+			es.SendEventMessageCounted("4", "", "")
+		}
+		if count := es.ConsumersCount(); count != 0 {
+			t.Errorf("%s: expected the slow consumer to be removed, got %d consumers", name, count)
+		}
+		if drops := atomic.LoadUint64(&c.drops); drops == 0 {
+			t.Errorf("%s: expected drops to be counted", name)
+		}
+
+		io.Copy(io.Discard, client)
+		if err := <-disconnected; err != ErrSlowConsumer {
+			t.Errorf("%s: expected ErrSlowConsumer, got %v", name, err)
+		}
+		es.Close()
+	}
+}
+
+func TestMaxQueuedBytes(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MaxQueuedBytes = 20
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	_, stuck := attachStuck(t, e.eventSource)
+	defer stuck.Close()
+	for e.eventSource.Stats().QueuedBytes > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, data := range []string{"2", "3", "4"} {
+		e.eventSource.SendEventMessageCounted(data, "", "")
+	}
+	if queued := e.eventSource.Stats().QueuedBytes; queued != 18 {
+		t.Errorf("expected 18 queued bytes, got %d", queued)
+	}
+
+	expected := "data: 1\n\ndata: 2\n\ndata: 3\n\n"
+	stuck.SetReadDeadline(time.Now().Add(time.Second))
+	resp := make([]byte, len(expected))
+	io.ReadFull(stuck, resp)
+	if string(resp) != expected {
+		t.Errorf("expected %q, got %q", expected, resp)
+	}
+	if queued := e.eventSource.Stats().QueuedBytes; queued != 0 {
+		t.Errorf("expected no queued bytes, got %d", queued)
+	}
+}
+
+func TestWriteBatching(t *testing.T) {
+	var frames int32
+	settings := DefaultSettings()
+	settings.MaxBatchSize = 1024
+	settings.FlushInterval = 50 * time.Millisecond
+	settings.OnFrame = func(id ConsumerID, size int) {
+		atomic.AddInt32(&frames, 1)
+	}
+	es := New(settings, nil)
+	defer es.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	if _, err := es.AttachConn(server); err != nil {
+		t.Fatal(err)
+	}
+	for es.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, data := range []string{"1", "2", "3"} {
+		es.SendEventMessage(data, "", "")
+	}
+	// net.Pipe returns a single write per read
+	resp := read(t, client)
+	expected := "data: 1\n\ndata: 2\n\ndata: 3\n\n"
+	if got := string(bytes.TrimRight(resp, "\x00")); got != expected {
+		t.Errorf("expected a single write %q, got %q", expected, got)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&frames); n != 3 {
+		t.Errorf("expected OnFrame to be called for 3 frames, got %d", n)
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MessageTTL = 50 * time.Millisecond
+	es := New(settings, nil)
+	defer es.Close()
+
+	_, client := attachStuck(t, es)
+	defer client.Close()
+	es.SendEventMessageCounted("2", "", "")
+	es.Send(Event{Data: "3", TTL: time.Hour})
+	time.Sleep(100 * time.Millisecond)
+
+	expected := "data: 1\n\ndata: 3\n\n"
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	resp := make([]byte, len(expected))
+	io.ReadFull(client, resp)
+	if string(resp) != expected {
+		t.Errorf("expected %q, got %q", expected, resp)
+	}
+	if expired := es.Stats().Expired; expired != 1 {
+		t.Errorf("expected 1 expired event, got %d", expired)
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConsumerBufferSize = 2
+	es := New(settings, nil)
+	defer es.Close()
+
+	_, client := attachStuck(t, es)
+	defer client.Close()
+	es.SendEventMessageCounted("2", "", "")
+	es.SendEventMessageCounted("3", "", "")
+	if delivered, dropped, _ := es.SendRetryMessageCounted(3 * time.Second); delivered != 1 || dropped != 0 {
+		t.Errorf("expected the retry message to be delivered, got %d delivered and %d dropped", delivered, dropped)
+	}
+
+	expected := "data: 1\n\nretry: 3000\n\ndata: 2\n\ndata: 3\n\n"
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	resp := make([]byte, len(expected))
+	io.ReadFull(client, resp)
+	if string(resp) != expected {
+		t.Errorf("expected %q, got %q", expected, resp)
+	}
+}
+
+func TestTrySend(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConsumerBufferSize = 1
+	settings.OverflowPolicy = Block
+	settings.OverflowTimeout = 500 * time.Millisecond
+	es := New(settings, nil)
+
+	_, client := attachStuck(t, es)
+	defer client.Close()
+	es.SendEventMessageCounted("2", "", "")
+	// the control goroutine blocks on the full buffer, then the sink fills
+	es.SendEventMessage("3", "", "")
+	es.SendEventMessage("4", "", "")
+
+	if es.TrySendEventMessage("5", "", "") {
+		t.Error("expected TrySendEventMessage to fail while the control goroutine is busy")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := es.SendEventMessageContext(ctx, "5", "", ""); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if err := es.SendEventMessageContext(context.Background(), "5", "", ""); err != nil {
+		t.Errorf("expected the message to be sent once the control goroutine is free, got %v", err)
+	}
+
+	es.Close()
+	if es.TrySendEventMessage("6", "", "") {
+		t.Error("expected TrySendEventMessage to fail once closed")
+	}
+	if err := es.SendEventMessageContext(context.Background(), "6", "", ""); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSendEvents(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConsumerBufferSize = 1
+	es := New(settings, nil)
+	defer es.Close()
+
+	if err := es.SendEvents(nil); err != nil {
+		t.Errorf("expected no error for an empty batch, got %v", err)
+	}
+
+	_, client := attachStuck(t, es)
+	defer client.Close()
+	// the whole batch fits into a single slot of the buffer
+	es.SendEvents([]Event{
+		{ID: "2", Type: "snapshot", Data: "full"},
+		{ID: "3", Type: "delta", Data: "a\nb"},
+	})
+	if _, dropped, _ := es.SendEventMessageCounted("4", "", ""); dropped != 1 {
+		t.Errorf("expected the following message dropped, got %d dropped", dropped)
+	}
+
+	expected := "data: 1\n\nid: 2\nevent: snapshot\ndata: full\n\nid: 3\nevent: delta\ndata: a\ndata: b\n\n"
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	resp := make([]byte, len(expected))
+	io.ReadFull(client, resp)
+	if string(resp) != expected {
+		t.Errorf("expected %q, got %q", expected, resp)
+	}
+}
+
+func TestSendEventsFiltered(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConsumerFilter = func(req *http.Request, e Event) bool {
+		return e.Type == req.URL.Query().Get("tenant")
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	acme, _ := startEventStreamURI(t, e, "/?tenant=acme")
+	defer acme.Close()
+	globex, _ := startEventStreamURI(t, e, "/?tenant=globex")
+	defer globex.Close()
+	initech, _ := startEventStreamURI(t, e, "/?tenant=initech")
+	defer initech.Close()
+
+	e.eventSource.SendEvents([]Event{
+		{Type: "acme", Data: "1"},
+		{Type: "globex", Data: "2"},
+		{Type: "acme", Data: "3"},
+	})
+	e.eventSource.SendEventMessage("4", "initech", "")
+	time.Sleep(100 * time.Millisecond)
+	for conn, expected := range map[net.Conn]string{
+		acme:   "event: acme\ndata: 1\n\nevent: acme\ndata: 3\n\n",
+		globex: "event: globex\ndata: 2\n\n",
+		// nothing of the batch is written to a consumer without any event
+		initech: "event: initech\ndata: 4\n\n",
+	} {
+		if resp := bytes.TrimRight(read(t, conn), "\x00"); string(resp) != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, resp)
+		}
+	}
+}
+
+func TestStickyEvents(t *testing.T) {
+	settings := DefaultSettings()
+	settings.StickyEvents = true
+	es := New(settings, nil)
+	defer es.Close()
+
+	es.SendEventMessage("1", "price", "")
+	es.SendEventMessage("on", "status", "")
+	es.SendEventMessage("2", "price", "")
+	es.SendEvents([]Event{{Type: "volume", Data: "10"}})
+	es.SendEventMessageToChannel("secret", "status", "", "private")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	if _, err := es.AttachConn(server); err != nil {
+		t.Fatal(err)
+	}
+	es.SendEventMessage("3", "price", "")
+
+	expected := "event: status\ndata: on\n\nevent: price\ndata: 2\n\nevent: volume\ndata: 10\n\nevent: price\ndata: 3\n\n"
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	resp := make([]byte, len(expected))
+	io.ReadFull(client, resp)
+	if string(resp) != expected {
+		t.Errorf("expected %q, got %q", expected, resp)
+	}
+}
+
+func TestOnConnectSend(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Strict = true
+	settings.OnConnectSend = func(req *http.Request) []Event {
+		return []Event{
+			{Type: "welcome", Data: req.URL.Query().Get("name")},
+			{Type: "bad\nname", Data: "skipped"},
+			{ID: "5", Type: "snapshot", Data: "state"},
+		}
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, resp := startEventStreamURI(t, e, "/?name=joe")
+	defer conn.Close()
+	e.eventSource.SendEventMessage("live", "", "")
+
+	time.Sleep(100 * time.Millisecond)
+	got := string(bytes.TrimRight(resp, "\x00")) + string(bytes.TrimRight(read(t, conn), "\x00"))
+	expected := "\r\n\r\nevent: welcome\ndata: joe\n\nid: 5\nevent: snapshot\ndata: state\n\ndata: live\n\n"
+	if !strings.HasSuffix(got, expected) {
+		t.Errorf("expected the snapshot before live events, got:\n%s", got)
+	}
+}
+
+func TestCatchUpHandoff(t *testing.T) {
+	const total = 500
+	settings := DefaultSettings()
+	settings.HistorySize = total
+	settings.ConsumerBufferSize = total
+	settings.OnConnectSend = func(req *http.Request) []Event {
+		if id := req.Header.Get("X-Snapshot"); id != "" {
+			return []Event{{ID: id, Type: "snapshot"}}
+		}
+		return nil
+	}
+	es := New(settings, nil)
+	defer es.Close()
+
+	var lastSent int64
+	published := make(chan bool)
+	go func() {
+		for i := 1; i <= total; i++ {
+			es.SendEventMessageCounted("", "", strconv.Itoa(i))
+			atomic.StoreInt64(&lastSent, int64(i))
+		}
+		close(published)
+	}()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		for atomic.LoadInt64(&lastSent) < int64(n*total/5) {
+			time.Sleep(10 * time.Microsecond)
+		}
+		from := atomic.LoadInt64(&lastSent)
+		req := httptest.NewRequest("GET", "/", nil)
+		expected := from + 1
+		if from == 0 {
+			// without Last-Event-ID the stream starts at the attach point
+			expected = -1
+		} else if n%2 == 0 {
+			req.Header.Set("Last-Event-ID", strconv.FormatInt(from, 10))
+		} else {
+			// the snapshot comes first, then the events following it
+			req.Header.Set("X-Snapshot", strconv.FormatInt(from, 10))
+			expected = from
+		}
+		client, server := net.Pipe()
+		// the header block is written by AttachConn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			r := bufio.NewReader(client)
+			resp, err := http.ReadResponse(r, req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for expected <= total {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					t.Errorf("consumer from %d: %v before id %d", from, err, expected)
+					return
+				}
+				if !strings.HasPrefix(line, "id: ") {
+					continue
+				}
+				id, _ := strconv.ParseInt(strings.TrimSpace(line[4:]), 10, 64)
+				if expected != -1 && id != expected {
+					t.Errorf("consumer from %d: expected id %d, got %d", from, expected, id)
+					return
+				}
+				expected = id + 1
+			}
+			resp.Body.Close()
+		}()
+		if _, err := es.AttachConn(server, WithResponseHeaders(req)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-published
+	wg.Wait()
+}
+
+func TestAutoIDs(t *testing.T) {
+	settings := DefaultSettings()
+	settings.AutoIDs = true
+	settings.HistorySize = 10
+	es := New(settings, nil)
+	defer es.Close()
+
+	if id := es.LastEventID(); id != "" {
+		t.Errorf("expected no last event id, got %q", id)
+	}
+	es.SendEventMessageCounted("a", "", "")
+	es.SendEventMessageCounted("b", "", "custom")
+	es.SendEvents([]Event{{Data: "c"}, {Data: "d"}})
+	es.SendEventMessageToChannel("e", "", "", "private")
+	es.SendEventMessageCounted("f", "", "")
+	if id := es.LastEventID(); id != "4" {
+		t.Errorf("expected last event id 4, got %q", id)
+	}
+
+	// the ids are replayed from the history
+	client, server := net.Pipe()
+	defer client.Close()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	go es.AttachConn(server, WithResponseHeaders(req))
+	r := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := http.ReadResponse(r, req); err != nil {
+		t.Fatal(err)
+	}
+	expected := "id: custom\ndata: b\n\nid: 2\ndata: c\n\nid: 3\ndata: d\n\nid: 4\ndata: f\n\n"
+	resp := make([]byte, len(expected))
+	io.ReadFull(r, resp)
+	if string(resp) != expected {
+		t.Errorf("expected %q, got %q", expected, resp)
+	}
+}
+
+func TestAutoIDsContinueStore(t *testing.T) {
+	store := new(sliceStore)
+	for i := 1; i <= 20; i++ {
+		store.Append(Event{ID: strconv.Itoa(i), Data: "stored"})
+	}
+	settings := DefaultSettings()
+	settings.AutoIDs = true
+	settings.EventStore = store
+	es := New(settings, nil)
+	defer es.Close()
+
+	if id := es.LastEventID(); id != "20" {
+		t.Errorf("expected last event id 20, got %q", id)
+	}
+	es.SendEventMessageCounted("a", "", "")
+	if id := es.LastEventID(); id != "21" {
+		t.Errorf("expected last event id 21, got %q", id)
+	}
+
+	// a client resuming from before the restart gets the new event after
+	// the stored ones
+	client, server := net.Pipe()
+	defer client.Close()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Last-Event-ID", "19")
+	go es.AttachConn(server, WithResponseHeaders(req))
+	r := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := http.ReadResponse(r, req); err != nil {
+		t.Fatal(err)
+	}
+	expected := "id: 20\ndata: stored\n\nid: 21\ndata: a\n\n"
+	resp := make([]byte, len(expected))
+	io.ReadFull(r, resp)
+	if string(resp) != expected {
+		t.Errorf("expected %q, got %q", expected, resp)
+	}
+}
+
+type fixedStats Stats
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func (s fixedStats) Stats() Stats {
+	return Stats(s)
+}
+
+func TestStatsDEmitter(t *testing.T) {
+	stats := fixedStats{
+		Reconnections: 3,
+		WriteLatency:  LatencyStats{Count: 2, P50: 1500 * time.Microsecond},
+		FanOut:        []PartitionStats{{Delivered: 5}},
+	}
+	var packets []string
+	e := &StatsDEmitter{
+		Collector: stats,
+		Writer: writerFunc(func(b []byte) (int, error) {
+			packets = append(packets, string(b))
+			return len(b), nil
+		}),
+		Prefix: "app.",
+	}
+	if err := e.Emit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 {
+		t.Fatalf("expected a single packet, got %d", len(packets))
+	}
+	for _, line := range []string{
+		"app.reconnections:3|g\n",
+		"app.write_latency.p50_ms:1.5|g\n",
+		"app.fanout.0.delivered:5|g\n",
+		"app.fanout.0.dropped:0|g",
+	} {
+		if !strings.Contains(packets[0], line) {
+			t.Errorf("expected %q in the packet, got:\n%s", line, packets[0])
+		}
+	}
+}
+
+// expvarRuns numbers the runs of TestPublishExpvar, as expvar panics when
+// a name is published twice, e.g. with -count.
+var expvarRuns int
+
+func TestPublishExpvar(t *testing.T) {
+	expvarRuns++
+	name := fmt.Sprintf("eventsource_test_%d", expvarRuns)
+	PublishExpvar(name, fixedStats{Goroutines: 7})
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatal("expected the variable to be published")
+	}
+	if s := v.String(); !strings.Contains(s, `"goroutines":7`) {
+		t.Errorf("expected the goroutines gauge, got %s", s)
+	}
+}
+
+func TestOnBroadcast(t *testing.T) {
+	type key struct{}
+	broadcasts := make(chan BroadcastInfo, 2)
+	settings := DefaultSettings()
+	settings.OnBroadcast = func(ctx context.Context, info BroadcastInfo) {
+		if ctx.Value(key{}) == nil && info.Event == "traced" {
+			t.Error("expected the context of the send")
+		}
+		broadcasts <- info
+	}
+	es := New(settings, nil)
+	defer es.Close()
+
+	_, client := attachStuck(t, es)
+	defer client.Close()
+	<-broadcasts
+
+	ctx := context.WithValue(context.Background(), key{}, true)
+	sent := time.Now()
+	es.SendEventMessageContext(ctx, "payload", "traced", "7")
+	info := <-broadcasts
+	if info.Event != "traced" || info.ID != "7" || info.Consumers != 1 || info.Delivered != 1 || info.Dropped != 0 {
+		t.Errorf("unexpected broadcast info %+v", info)
+	}
+	if expected := len("id: 7\nevent: traced\ndata: payload\n\n"); info.Bytes != expected {
+		t.Errorf("expected %d bytes, got %d", expected, info.Bytes)
+	}
+	if info.Start.Before(sent) || time.Since(info.Start) > time.Second {
+		t.Errorf("expected the broadcast to start when the event was sent, got %v", info.Start)
+	}
+}
+
+type recordingLogger struct {
+	lock    sync.Mutex
+	records []string
+}
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.records = append(l.records, fmt.Sprint(level, " ", msg, args))
+}
+
+func (l *recordingLogger) Info(msg string, args ...interface{}) {
+	l.record("INFO", msg, args)
+}
+
+func (l *recordingLogger) Error(msg string, args ...interface{}) {
+	l.record("ERROR", msg, args)
+}
+
+func (l *recordingLogger) has(prefix string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, r := range l.records {
+		if strings.HasPrefix(r, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	settings := DefaultSettings()
+	settings.ConsumerBufferSize = 1
+	settings.Logger = logger
+	es := New(settings, nil)
+
+	c, client := attachStuck(t, es)
+	es.SendEventMessageCounted("2", "", "")
+	es.SendEventMessageCounted("3", "", "")
+	client.Close()
+	es.Close()
+	<-c.done
+
+	for _, prefix := range []string{
+		fmt.Sprintf("INFO Dropped a message for a consumer[consumer %d", c.id),
+		fmt.Sprintf("INFO Consumer disconnected[consumer %d", c.id),
+		"INFO Closed the event source[consumers 1]",
+	} {
+		if !logger.has(prefix) {
+			t.Errorf("expected a record starting with %q, got %q", prefix, logger.records)
+		}
+	}
+}
+
+func TestOnError(t *testing.T) {
+	errs := make(chan error, 10)
+	settings := DefaultSettings()
+	settings.ConsumerBufferSize = 1
+	settings.OverflowPolicy = DisconnectConsumer
+	settings.OnError = func(id ConsumerID, err error) {
+		errs <- err
+	}
+	es := New(settings, nil)
+	defer es.Close()
+
+	// the response headers can't be written
+	client, server := net.Pipe()
+	client.Close()
+	if _, err := es.AttachConn(server, WithResponseHeaders(nil)); err == nil {
+		t.Fatal("expected AttachConn to fail")
+	}
+	if err := <-errs; err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe, got %v", err)
+	}
+
+	_, client = attachStuck(t, es)
+	defer client.Close()
+	es.SendEventMessageCounted("2", "", "")
+	es.SendEventMessageCounted("3", "", "")
+	if err := <-errs; err != ErrBufferOverflow {
+		t.Errorf("expected ErrBufferOverflow, got %v", err)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	e := setup(t)
+	defer teardown(t, e)
+
+	conn, _ := startEventStreamRequest(t, e, "GET /?channels=news,sport HTTP/1.1\r\nHost: localhost\r\nUser-Agent: tester\r\n\r\n")
+	defer conn.Close()
+	for e.eventSource.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	e.eventSource.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug", nil))
+	var consumers []struct {
+		ConsumerInfo
+		Uptime string
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &consumers); err != nil {
+		t.Fatal(err)
+	}
+	if len(consumers) != 1 {
+		t.Fatalf("expected 1 consumer, got %d", len(consumers))
+	}
+	c := consumers[0]
+	if c.UserAgent != "tester" || strings.Join(c.Channels, ",") != "news,sport" || c.RemoteAddr != conn.LocalAddr().String() || c.Uptime == "" {
+		t.Errorf("unexpected consumer %+v", c)
+	}
+
+	rec = httptest.NewRecorder()
+	e.eventSource.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug?format=html", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "<td>tester</td>") || !strings.Contains(body, "<td>news, sport</td>") {
+		t.Errorf("expected the consumer in the HTML table, got:\n%s", body)
+	}
+}
+
+func TestConsumers(t *testing.T) {
+	settings := DefaultSettings()
+	connected := make(chan ConsumerID, 1)
+	var es EventSource
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		if err := es.SetConsumerValue(id, "user-42"); err != nil {
+			t.Error(err)
+		}
+		connected <- id
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+	es = e.eventSource
+
+	conn, _ := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nUser-Agent: tester\r\nX-Tenant: acme\r\n\r\n")
+	defer conn.Close()
+	id := <-connected
+
+	consumers := es.Consumers()
+	if len(consumers) != 1 {
+		t.Fatalf("expected 1 consumer, got %d", len(consumers))
+	}
+	c := consumers[0]
+	if c.ID != id || c.UserAgent != "tester" || c.RemoteAddr != conn.LocalAddr().String() || c.Header.Get("X-Tenant") != "acme" || c.Value != "user-42" {
+		t.Errorf("unexpected consumer %+v", c)
+	}
+
+	if err := es.SetConsumerValue(id+1, "nobody"); err != ErrConsumerNotFound {
+		t.Errorf("expected ErrConsumerNotFound, got %v", err)
+	}
+}
+
+func TestConsumerInfoLastError(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Timeout = 50 * time.Millisecond
+	settings.CloseOnTimeout = false
+	es := New(settings, nil)
+	defer es.Close()
+
+	_, client := attachStuck(t, es)
+	defer client.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	consumers := es.Consumers()
+	if len(consumers) != 1 {
+		t.Fatalf("expected 1 consumer, got %d", len(consumers))
+	}
+	if netErr, ok := consumers[0].LastError.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected a write timeout, got %v", consumers[0].LastError)
+	}
+
+	rec := httptest.NewRecorder()
+	es.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug", nil))
+	if !strings.Contains(rec.Body.String(), `"last_error":`) {
+		t.Errorf("expected the last error to be listed, got %s", rec.Body)
+	}
+}
+
+func TestCloseConsumer(t *testing.T) {
+	settings := DefaultSettings()
+	ids := make(chan ConsumerID, 2)
+	disconnected := make(chan error, 1)
+	settings.OnConnect = func(req *http.Request, id ConsumerID) {
+		ids <- id
+	}
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		disconnected <- err
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	id := <-ids
+	other, _ := startEventStream(t, e)
+	defer other.Close()
+	<-ids
+
+	e.eventSource.SendEventMessageTo(id, "queued", "", "")
+	if err := e.eventSource.CloseConsumer(id, &Event{Type: "kicked", Data: "unauthenticated"}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "data: queued\n\nevent: kicked\ndata: unauthenticated\n\n"; string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+	if err := <-disconnected; err != ErrConsumerClosed {
+		t.Errorf("expected ErrConsumerClosed, got %v", err)
+	}
+	if n := e.eventSource.ConsumersCount(); n != 1 {
+		t.Errorf("expected 1 consumer left, got %d", n)
+	}
+
+	if err := e.eventSource.CloseConsumer(id, nil); err != ErrConsumerNotFound {
+		t.Errorf("expected ErrConsumerNotFound, got %v", err)
+	}
+}
+
+func TestCloseConsumerFullBuffer(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConsumerBufferSize = 2
+	settings.OverflowPolicy = DropNewest
+	es := New(settings, nil)
+	defer es.Close()
+
+	c, client := attachStuck(t, es)
+	defer client.Close()
+	es.SendEventMessage("2", "", "")
+	es.SendEventMessage("3", "", "")
+
+	// the final event jumps the full buffer instead of being dropped
+	if err := es.CloseConsumer(c.id, &Event{Type: "kicked"}); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "data: 1\n\nevent: kicked\n\ndata: 2\n\ndata: 3\n\n"; string(got) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestMaxConsumers(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MaxConsumers = 1
+	settings.MaxConsumersRetryAfter = 1500 * time.Millisecond
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+
+	conn2, resp := startEventStream(t, e)
+	conn2.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 503 Service Unavailable\r\n") || !strings.Contains(string(resp), "Retry-After: 2\r\n") {
+		t.Fatalf("expected 503 response with Retry-After, got:\n%s", resp)
+	}
+
+	conn.Close()
+	e.eventSource.PruneIdle(0)
+	time.Sleep(100 * time.Millisecond)
+
+	conn3, resp := startEventStream(t, e)
+	defer conn3.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("expected connection to be accepted, got:\n%s", resp)
+	}
+}
+
+func TestMaxConsumersDefaultRetryAfter(t *testing.T) {
+	// settings built without DefaultSettings
+	settings := &Settings{Timeout: time.Second, IdleTimeout: time.Minute, MaxConsumers: 1}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+	conn2, resp := startEventStream(t, e)
+	conn2.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 503 Service Unavailable\r\n") || !strings.Contains(string(resp), "Retry-After: 5\r\n") {
+		t.Fatalf("expected 503 response with the default Retry-After, got:\n%s", resp)
+	}
+}
+
+func TestMaxAcceptRatePerIP(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MaxAcceptRatePerIP = 1
+	settings.AcceptBurstPerIP = 2
+	settings.MinRetry = 3 * time.Second
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	for i := 0; i < 2; i++ {
+		conn, resp := startEventStream(t, e)
+		defer conn.Close()
+		if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+			t.Fatalf("expected connection to be accepted, got:\n%s", resp)
+		}
+	}
+	conn, resp := startEventStream(t, e)
+	conn.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 429 Too Many Requests\r\n") || !strings.Contains(string(resp), "Retry-After: 3\r\n") {
+		t.Fatalf("expected 429 response with Retry-After of MinRetry, got:\n%s", resp)
+	}
+
+	t.Log("limit keys separately")
+	now := time.Now()
+	limiter := newKeyedLimiter(1, 1)
+	if ok, _ := limiter.take("10.0.0.1", now); !ok {
+		t.Error("expected first connection of 10.0.0.1 to be accepted")
+	}
+	if ok, wait := limiter.take("10.0.0.1", now); ok || wait != time.Second {
+		t.Errorf("expected second connection of 10.0.0.1 to wait 1s, got %v, %v", ok, wait)
+	}
+	if ok, _ := limiter.take("10.0.0.2", now); !ok {
+		t.Error("expected first connection of 10.0.0.2 to be accepted")
+	}
+	limiter.take("10.0.0.3", now.Add(2*time.Second))
+	if n := len(limiter.buckets); n != 1 {
+		t.Errorf("expected refilled buckets to be swept, got %d buckets", n)
+	}
+}
+
+func TestMaxConnectionsPerKey(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConnectionKey = func(req *http.Request) string {
+		return req.Header.Get("X-User")
+	}
+	settings.MaxConnectionsPerKey = 1
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	request := func(user string) string {
+		return "GET / HTTP/1.1\r\nHost: localhost\r\nX-User: " + user + "\r\n\r\n"
+	}
+	conn, _ := startEventStreamRequest(t, e, request("alice"))
+	conn2, resp := startEventStreamRequest(t, e, request("alice"))
+	conn2.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 429 Too Many Requests\r\n") {
+		t.Fatalf("expected 429 response, got:\n%s", resp)
+	}
+	conn3, resp := startEventStreamRequest(t, e, request("bob"))
+	defer conn3.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Fatalf("expected connection of another key to be accepted, got:\n%s", resp)
+	}
+
+	conn.Close()
+	e.eventSource.PruneIdle(0)
+	time.Sleep(100 * time.Millisecond)
+	conn4, resp := startEventStreamRequest(t, e, request("alice"))
+	defer conn4.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("expected connection to be accepted once the slot is freed, got:\n%s", resp)
+	}
+}
+
+func TestEvictOldestConnection(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ConnectionKey = func(req *http.Request) string {
+		return req.Header.Get("X-User")
+	}
+	settings.MaxConnectionsPerKey = 1
+	settings.EvictOldestConnection = true
+	disconnected := make(chan error, 1)
+	settings.OnDisconnect = func(id ConsumerID, err error) {
+		disconnected <- err
+	}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\nX-User: alice\r\n\r\n"
+	conn, _ := startEventStreamRequest(t, e, request)
+	defer conn.Close()
+	conn2, resp := startEventStreamRequest(t, e, request)
+	defer conn2.Close()
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Fatalf("expected newest connection to be accepted, got:\n%s", resp)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("expected oldest connection to be closed, got %v", err)
+	}
+	if err := <-disconnected; err != ErrConnectionLimit {
+		t.Errorf("expected ErrConnectionLimit, got %v", err)
+	}
+	if n := e.eventSource.ConsumersCount(); n != 1 {
+		t.Errorf("expected 1 consumer, got %d", n)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Throttle = map[string]time.Duration{"price": 100 * time.Millisecond}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	start := time.Now()
+	for _, price := range []string{"1", "2", "3"} {
+		e.eventSource.SendEventMessage(price, "price", "")
+	}
+	e.eventSource.SendEventMessage("hello", "", "")
+
+	// the held price may come within the same read as the others, so the
+	// frames are read up to it at once
+	expected := "event: price\ndata: 1\n\ndata: hello\n\nevent: price\ndata: 3\n\n"
+	resp := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if string(resp) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, resp)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected the latest price at the end of the window, got it after %v", elapsed)
+	}
+
+	t.Log("flush held events on close")
+	e.eventSource.SendEventMessage("4", "price", "")
+	e.eventSource.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if got, _ := io.ReadAll(conn); string(got) != "event: price\ndata: 4\n\n" {
+		t.Errorf("expected the held price to be flushed, got:\n%s", got)
+	}
+}
+
+func TestSuppressDuplicateEvents(t *testing.T) {
+	settings := DefaultSettings()
+	settings.SuppressDuplicateEvents = true
+	settings.MaxDuplicateSuppression = 100 * time.Millisecond
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, _ := startEventStream(t, e)
+	defer conn.Close()
+
+	// only consecutive duplicates are dropped, A, B, A sends all three
+	e.eventSource.SendEventMessage("on", "state", "1")
+	e.eventSource.SendEventMessage("on", "state", "2")
+	e.eventSource.SendEventMessage("on", "other", "3")
+	e.eventSource.SendEventMessage("on", "state", "4")
+	e.eventSource.SendEventMessage("off", "state", "5")
+	e.eventSource.SendEventMessage("off", "state", "6")
+	expectResponse(t, conn, "id: 1\nevent: state\ndata: on\n\nid: 3\nevent: other\ndata: on\n\n"+
+		"id: 4\nevent: state\ndata: on\n\nid: 5\nevent: state\ndata: off\n\n")
+
+	time.Sleep(150 * time.Millisecond)
+	e.eventSource.SendEventMessage("off", "state", "7")
+	expectResponse(t, conn, "id: 7\nevent: state\ndata: off\n\n")
+}
+
+func TestGzip(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Gzip = true
+	settings.GzipLevel = gzip.BestSpeed
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	// the second connection reuses the writer of the first one
+	for _, data := range []string{"first", "second"} {
+		conn, resp := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+		if !strings.Contains(string(resp), "Content-Encoding: gzip\r\n") {
+			t.Fatalf("expected gzip response, got:\n%s", resp)
+		}
+		e.eventSource.SendEventMessage(data, "", "")
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		gz, err := gzip.NewReader(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "data: " + data + "\n\n"
+		got := make([]byte, len(expected))
+		if _, err := io.ReadFull(gz, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+		}
+
+		conn.Close()
+		e.eventSource.PruneIdle(0)
+		for e.eventSource.Stats().Goroutines > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// upperCompressor "compresses" by upper-casing.
+type upperCompressor struct {
+	w io.Writer
+}
+
+func (u *upperCompressor) Write(b []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(b))
+}
+
+func (u *upperCompressor) Flush() error {
+	return nil
+}
+
+func (u *upperCompressor) Close() error {
+	return nil
+}
+
+func TestEncodings(t *testing.T) {
+	settings := DefaultSettings()
+	settings.Gzip = true
+	settings.Encodings = []Encoding{{
+		Name: "x-upper",
+		NewCompressor: func(w io.Writer) Compressor {
+			return &upperCompressor{w: w}
+		},
+	}}
+	e := setupWithCustomSettings(t, settings)
+	defer teardown(t, e)
+
+	conn, resp := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip, x-upper;q=0.5\r\n\r\n")
+	defer conn.Close()
+	if !strings.Contains(string(resp), "Content-Encoding: x-upper\r\n") {
+		t.Fatalf("expected the preferred encoding, got:\n%s", resp)
+	}
+	e.eventSource.SendEventMessage("hello", "", "")
+	expectResponse(t, conn, "DATA: HELLO\n\n")
+
+	conn2, resp := startEventStreamRequest(t, e, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: x-upper;q=0, gzip\r\n\r\n")
+	defer conn2.Close()
+	if !strings.Contains(string(resp), "Content-Encoding: gzip\r\n") {
+		t.Errorf("expected gzip for a client refusing x-upper, got:\n%s", resp)
+	}
+
+	conn3, resp := startEventStream(t, e)
+	defer conn3.Close()
+	if strings.Contains(string(resp), "Content-Encoding") {
+		t.Errorf("expected no encoding without Accept-Encoding, got:\n%s", resp)
+	}
+}
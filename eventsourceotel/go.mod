@@ -0,0 +1,20 @@
+module github.com/antage/eventsource/eventsourceotel
+
+go 1.18
+
+require (
+	github.com/antage/eventsource/v2 v2.0.0
+	go.opentelemetry.io/otel v1.14.0
+	go.opentelemetry.io/otel/sdk v1.14.0
+	go.opentelemetry.io/otel/trace v1.14.0
+)
+
+require (
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	golang.org/x/sys v0.5.0 // indirect
+)
+
+// the module is developed against the root module in this repository,
+// modules depending on it ignore the replacement and get v2.0.0
+replace github.com/antage/eventsource/v2 => ../
@@ -0,0 +1,164 @@
+// Package eventsourceotel traces eventsource connections with OpenTelemetry.
+//
+// Every consumer connection is recorded as a span which starts when the
+// consumer is connected and ends when it's disconnected. Every frame
+// written to the consumer is recorded as a span event.
+//
+// Every broadcast is recorded as a span from the send call until the
+// message has been queued for all consumers, a child of the span in the
+// context passed to SendEventMessageContext, if any.
+package eventsourceotel
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/antage/eventsource/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// SpanName is the name of connection spans.
+	SpanName = "eventsource.connection"
+
+	// FrameEventName is the name of span events recorded for frames.
+	FrameEventName = "eventsource.frame"
+
+	// BroadcastSpanName is the name of broadcast spans.
+	BroadcastSpanName = "eventsource.broadcast"
+)
+
+type tracing struct {
+	tracer trace.Tracer
+
+	spansLock sync.Mutex
+	spans     map[eventsource.ConsumerID]trace.Span
+}
+
+// Instrument sets connection hooks in settings to record spans with
+// tracer. Hooks already set in settings are still called. If settings is
+// nil, default settings are used. Instrument returns the updated settings.
+//
+// The trace context of a connection span is extracted from the request
+// headers with the global propagator, falling back to the request context.
+func Instrument(settings *eventsource.Settings, tracer trace.Tracer) *eventsource.Settings {
+	if settings == nil {
+		settings = eventsource.DefaultSettings()
+	}
+
+	t := &tracing{
+		tracer: tracer,
+		spans:  make(map[eventsource.ConsumerID]trace.Span),
+	}
+
+	onConnect := settings.OnConnect
+	settings.OnConnect = func(req *http.Request, id eventsource.ConsumerID) {
+		t.connect(req, id)
+		if onConnect != nil {
+			onConnect(req, id)
+		}
+	}
+
+	onFrame := settings.OnFrame
+	settings.OnFrame = func(id eventsource.ConsumerID, size int) {
+		t.frame(id, size)
+		if onFrame != nil {
+			onFrame(id, size)
+		}
+	}
+
+	onBroadcast := settings.OnBroadcast
+	settings.OnBroadcast = func(ctx context.Context, info eventsource.BroadcastInfo) {
+		t.broadcast(ctx, info)
+		if onBroadcast != nil {
+			onBroadcast(ctx, info)
+		}
+	}
+
+	onDisconnect := settings.OnDisconnect
+	settings.OnDisconnect = func(id eventsource.ConsumerID, err error) {
+		if onDisconnect != nil {
+			onDisconnect(id, err)
+		}
+		t.disconnect(id, err)
+	}
+
+	return settings
+}
+
+func (t *tracing) connect(req *http.Request, id eventsource.ConsumerID) {
+	// connections attached without a request have no parent nor request
+	// attributes
+	ctx := context.Background()
+	attrs := []attribute.KeyValue{attribute.Int64("eventsource.consumer.id", int64(id))}
+	if req != nil {
+		ctx = otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		attrs = append(attrs,
+			attribute.String("net.peer.addr", req.RemoteAddr),
+			attribute.String("http.target", req.URL.RequestURI()),
+		)
+	}
+	_, span := t.tracer.Start(
+		ctx,
+		SpanName,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+
+	t.spansLock.Lock()
+	defer t.spansLock.Unlock()
+
+	t.spans[id] = span
+}
+
+func (t *tracing) span(id eventsource.ConsumerID) trace.Span {
+	t.spansLock.Lock()
+	defer t.spansLock.Unlock()
+
+	return t.spans[id]
+}
+
+func (t *tracing) frame(id eventsource.ConsumerID, size int) {
+	if span := t.span(id); span != nil {
+		span.AddEvent(FrameEventName, trace.WithAttributes(attribute.Int("eventsource.frame.size", size)))
+	}
+}
+
+func (t *tracing) disconnect(id eventsource.ConsumerID, err error) {
+	t.spansLock.Lock()
+	span := t.spans[id]
+	delete(t.spans, id)
+	t.spansLock.Unlock()
+
+	if span != nil {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (t *tracing) broadcast(ctx context.Context, info eventsource.BroadcastInfo) {
+	_, span := t.tracer.Start(
+		ctx,
+		BroadcastSpanName,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithTimestamp(info.Start),
+		trace.WithAttributes(
+			attribute.String("eventsource.event.type", info.Event),
+			attribute.String("eventsource.event.id", info.ID),
+			attribute.Int("eventsource.consumers", info.Consumers),
+			attribute.Int("eventsource.delivered", info.Delivered),
+			attribute.Int("eventsource.dropped", info.Dropped),
+			attribute.Int("eventsource.bytes", info.Bytes),
+		),
+	)
+	span.End(trace.WithTimestamp(time.Now()))
+}
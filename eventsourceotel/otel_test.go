@@ -0,0 +1,151 @@
+package eventsourceotel
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antage/eventsource/v2"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrument(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	es := eventsource.New(Instrument(nil, provider.Tracer("test")), nil)
+	defer es.Close()
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /?a=b HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := make([]byte, 1024)
+	if _, err := conn.Read(resp); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	es.SendEventMessage("test", "", "")
+	time.Sleep(100 * time.Millisecond)
+	es.PruneIdle(0)
+	time.Sleep(100 * time.Millisecond)
+
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() != BroadcastSpanName {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 ended connection span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != SpanName {
+		t.Errorf("expected span name %q, got %q", SpanName, span.Name())
+	}
+	// the idle timeout is recorded after the frame
+	events := span.Events()
+	if len(events) != 2 || events[0].Name != FrameEventName || events[1].Name != "exception" {
+		t.Fatalf("expected a %q event and the idle timeout, got %v", FrameEventName, events)
+	}
+	if span.Status().Description != eventsource.ErrIdleTimeout.Error() {
+		t.Errorf("expected the idle timeout status, got %v", span.Status())
+	}
+	for _, attr := range events[0].Attributes {
+		if attr.Key == "eventsource.frame.size" && attr.Value.AsInt64() != int64(len("data: test\n\n")) {
+			t.Errorf("expected frame size %d, got %d", len("data: test\n\n"), attr.Value.AsInt64())
+		}
+	}
+}
+
+func TestInstrumentBroadcast(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := provider.Tracer("test")
+
+	es := eventsource.New(Instrument(nil, tracer), nil)
+	defer es.Close()
+
+	ctx, parent := tracer.Start(context.Background(), "publish")
+	if err := es.SendEventMessageContext(ctx, "data", "update", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// the counted send waits for the traced one to be broadcast
+	es.SendEventMessageCounted("untraced", "", "")
+	parent.End()
+
+	var broadcasts []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == BroadcastSpanName {
+			broadcasts = append(broadcasts, span)
+		}
+	}
+	if len(broadcasts) != 2 {
+		t.Fatalf("expected 2 broadcast spans, got %d", len(broadcasts))
+	}
+	span := broadcasts[0]
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("expected the broadcast span to be a child of the publisher span")
+	}
+	for _, attr := range span.Attributes() {
+		if attr.Key == "eventsource.event.type" && attr.Value.AsString() != "update" {
+			t.Errorf("expected event type %q, got %q", "update", attr.Value.AsString())
+		}
+	}
+	if broadcasts[1].Parent().IsValid() {
+		t.Error("expected the untraced broadcast span to be a root span")
+	}
+}
+
+func TestInstrumentAttachConn(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	es := eventsource.New(Instrument(nil, provider.Tracer("test")), nil)
+	defer es.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	// the connection hooks get a nil request
+	id, err := es.AttachConn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for es.ConsumersCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	es.PruneIdle(0)
+	time.Sleep(100 * time.Millisecond)
+
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == SpanName {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 ended connection span, got %d", len(spans))
+	}
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == "eventsource.consumer.id" && attr.Value.AsInt64() != int64(id) {
+			t.Errorf("expected consumer id %d, got %d", id, attr.Value.AsInt64())
+		}
+		if attr.Key == "http.target" {
+			t.Errorf("unexpected request attribute %v", attr)
+		}
+	}
+}
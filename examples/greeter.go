@@ -1,7 +1,7 @@
 package main
 
 import (
-	"gopkg.in/antage/eventsource.v1"
+	"github.com/antage/eventsource/v2"
 	"log"
 	"net/http"
 	"time"
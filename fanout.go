@@ -0,0 +1,85 @@
+package eventsource
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// fanOutJob is a broadcast handed to the fan-out workers.
+type fanOutJob struct {
+	m message
+
+	// frames are the frames cached before fanning out, read-only
+	frames map[frameKey][]byte
+
+	// counts are set by every worker at its index before calling Done
+	counts []deliveryCount
+	wg     sync.WaitGroup
+}
+
+// startFanOut starts the fan-out workers, worker w delivers to the
+// consumers of every registry shard i with i % workers == w.
+func (es *eventSource) startFanOut() {
+	for w, jobs := range es.fanOut {
+		go es.fanOutWorker(w, jobs)
+	}
+}
+
+// stopFanOut stops the fan-out workers once their jobs are done.
+func (es *eventSource) stopFanOut() {
+	for _, jobs := range es.fanOut {
+		close(jobs)
+	}
+}
+
+func (es *eventSource) fanOutWorker(w int, jobs <-chan *fanOutJob) {
+	for job := range jobs {
+		frames := make(map[frameKey][]byte, len(job.frames))
+		for key, frame := range job.frames {
+			frames[key] = frame
+		}
+
+		var total deliveryCount
+		for i := w; i < registryShards; i += len(es.fanOut) {
+			total.add(es.deliver(job.m, i, frames))
+		}
+		es.stats.partitions[w].add(total)
+		job.counts[w] = total
+		job.wg.Done()
+	}
+}
+
+// fanOutBroadcast delivers the message by the fan-out workers and waits
+// for them.
+func (es *eventSource) fanOutBroadcast(m message, frames map[frameKey][]byte) (total deliveryCount) {
+	job := &fanOutJob{m: m, frames: frames, counts: make([]deliveryCount, len(es.fanOut))}
+	job.wg.Add(len(es.fanOut))
+	for _, jobs := range es.fanOut {
+		jobs <- job
+	}
+	job.wg.Wait()
+
+	for _, count := range job.counts {
+		total.add(count)
+	}
+	return total
+}
+
+// partitionCounts counts the deliveries of a fan-out worker. Its fields
+// are accessed atomically.
+type partitionCounts struct {
+	delivered uint64
+	dropped   uint64
+}
+
+func (p *partitionCounts) add(count deliveryCount) {
+	atomic.AddUint64(&p.delivered, uint64(count.delivered))
+	atomic.AddUint64(&p.dropped, uint64(count.dropped))
+}
+
+func (p *partitionCounts) snapshot() PartitionStats {
+	return PartitionStats{
+		Delivered: atomic.LoadUint64(&p.delivered),
+		Dropped:   atomic.LoadUint64(&p.dropped),
+	}
+}
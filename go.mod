@@ -1,3 +1,3 @@
-module github.com/antage/eventsource
+module github.com/antage/eventsource/v2
 
 go 1.18
@@ -0,0 +1,68 @@
+package eventsource
+
+// EventStore keeps broadcast events for replaying them to consumers
+// reconnecting with a Last-Event-ID header. Its methods are called from
+// the control goroutine, so they block sending messages while running.
+type EventStore interface {
+	// Append stores a broadcast event.
+	Append(e Event) error
+
+	// After returns the stored events following the one with the id, in
+	// the order they were appended, or nil if there is no such event.
+	After(id string) ([]Event, error)
+}
+
+// LastEventIDStore is an EventStore knowing the id of the last event it
+// stores. With AutoIDs, numbering continues after it, so a durable store
+// implementing it never gets the ids of events stored before a restart
+// again.
+type LastEventIDStore interface {
+	EventStore
+
+	// LastEventID returns the id of the last event appended, "" if there
+	// is none.
+	LastEventID() (string, error)
+}
+
+// history is the in-memory EventStore keeping the most recently broadcast
+// events. It's used by the control goroutine only.
+type history struct {
+	// events is a ring buffer, start is the index of the oldest event
+	events []Event
+	start  int
+	size   int
+}
+
+func newHistory(size int) *history {
+	return &history{events: make([]Event, 0, size), size: size}
+}
+
+func (h *history) Append(e Event) error {
+	if len(h.events) < h.size {
+		h.events = append(h.events, e)
+		return nil
+	}
+	h.events[h.start] = e
+	h.start = (h.start + 1) % h.size
+	return nil
+}
+
+// After returns the events following the latest one with the id.
+func (h *history) After(id string) ([]Event, error) {
+	for i := len(h.events) - 1; i >= 0; i-- {
+		if h.at(i).ID != id {
+			continue
+		}
+		events := make([]Event, 0, len(h.events)-i-1)
+		for j := i + 1; j < len(h.events); j++ {
+			events = append(events, h.at(j))
+		}
+		return events, nil
+	}
+	return nil, nil
+}
+
+// at returns the i-th oldest event.
+func (h *history) at(i int) Event {
+	return h.events[(h.start+i)%len(h.events)]
+}
@@ -0,0 +1,46 @@
+package eventsource
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives log records with structured fields given as alternating
+// keys and values, e.g. "consumer", id, "error", err. A *slog.Logger is a
+// Logger. Methods may be called from any goroutine and shouldn't block.
+type Logger interface {
+	// Info logs routine events, e.g. a consumer disconnected or messages
+	// dropped.
+	Info(msg string, args ...interface{})
+
+	// Error logs failures, e.g. a connection which couldn't be set up.
+	Error(msg string, args ...interface{})
+}
+
+// DiscardLogger is a Logger discarding all records.
+var DiscardLogger Logger = discardLogger{}
+
+type discardLogger struct{}
+
+func (discardLogger) Info(msg string, args ...interface{})  {}
+func (discardLogger) Error(msg string, args ...interface{}) {}
+
+// stdLogger is the default Logger, it prints errors with the log package
+// and discards the rest.
+type stdLogger struct{}
+
+func (stdLogger) Info(msg string, args ...interface{}) {}
+
+func (stdLogger) Error(msg string, args ...interface{}) {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", args[i])
+		}
+	}
+	log.Print(b.String())
+}
@@ -0,0 +1,122 @@
+package eventsource
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"strconv"
+	"time"
+)
+
+// StatsCollector takes Stats snapshots, EventSource and SyncEventSource
+// are StatsCollectors.
+type StatsCollector interface {
+	Stats() Stats
+}
+
+// Metric is a named value of a Stats snapshot.
+type Metric struct {
+	Name  string
+	Value float64
+}
+
+// Metrics flattens the snapshot into metrics named like "reconnections",
+// "write_latency.p99_ms" and "fanout.0.dropped", in a stable order.
+// Counters are cumulative, latencies are in milliseconds.
+func (s Stats) Metrics() []Metric {
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	metrics := []Metric{
+		{"first_connections", float64(s.FirstConnections)},
+		{"reconnections", float64(s.Reconnections)},
+		{"goroutines", float64(s.Goroutines)},
+		{"queued_bytes", float64(s.QueuedBytes)},
+		{"expired", float64(s.Expired)},
+		{"write_latency.count", float64(s.WriteLatency.Count)},
+		{"write_latency.p50_ms", ms(s.WriteLatency.P50)},
+		{"write_latency.p95_ms", ms(s.WriteLatency.P95)},
+		{"write_latency.p99_ms", ms(s.WriteLatency.P99)},
+	}
+	for i, p := range s.FanOut {
+		prefix := "fanout." + strconv.Itoa(i) + "."
+		metrics = append(metrics,
+			Metric{prefix + "delivered", float64(p.Delivered)},
+			Metric{prefix + "dropped", float64(p.Dropped)},
+		)
+	}
+	return metrics
+}
+
+// PublishExpvar publishes the metrics of the collector as an expvar map
+// with the name, e.g. served on /debug/vars. Snapshots are taken whenever
+// the variable is read. Like expvar.Publish, it panics if the name is
+// already in use.
+func PublishExpvar(name string, collector StatsCollector) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		metrics := make(map[string]float64)
+		for _, m := range collector.Stats().Metrics() {
+			metrics[m.Name] = m.Value
+		}
+		return metrics
+	}))
+}
+
+// statsDPacketSize keeps StatsD packets within the payload of a UDP
+// datagram on a common Ethernet path.
+const statsDPacketSize = 1432
+
+// StatsDEmitter writes the metrics of a collector as StatsD gauges, e.g.
+// to a UDP connection to the StatsD daemon.
+type StatsDEmitter struct {
+	// Collector is where snapshots are taken from.
+	Collector StatsCollector
+
+	// Writer receives packets of newline separated gauges, each packet
+	// with a single Write.
+	Writer io.Writer
+
+	// Prefix is prepended to metric names, e.g. "myapp.events.".
+	Prefix string
+}
+
+// Emit writes the metrics of a new snapshot.
+func (e *StatsDEmitter) Emit() error {
+	var packet []byte
+	for _, m := range e.Collector.Stats().Metrics() {
+		line := append([]byte(e.Prefix), m.Name...)
+		line = append(line, ':')
+		line = strconv.AppendFloat(line, m.Value, 'f', -1, 64)
+		line = append(line, "|g"...)
+		if len(packet) > 0 && len(packet)+1+len(line) > statsDPacketSize {
+			if _, err := e.Writer.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) == 0 {
+		return nil
+	}
+	_, err := e.Writer.Write(packet)
+	return err
+}
+
+// Run emits metrics every interval until ctx is done, it returns the
+// context error. Write errors are ignored, StatsD is lossy anyway.
+func (e *StatsDEmitter) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Emit()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package eventsource
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a message for a consumer whose
+// buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the message.
+	DropNewest OverflowPolicy = iota
+
+	// DropOldest drops the oldest queued message to make room for the
+	// message.
+	DropOldest
+
+	// DisconnectConsumer drops the message and disconnects the consumer,
+	// recording ErrBufferOverflow as its last error, so the client
+	// reconnects and can catch up from the event store.
+	DisconnectConsumer
+
+	// Block waits up to Settings.OverflowTimeout for room in the buffer,
+	// then drops the message. Sending to all other consumers waits
+	// meanwhile.
+	Block
+)
+
+// ErrBufferOverflow is recorded as the last error of a consumer
+// disconnected by the DisconnectConsumer overflow policy.
+var ErrBufferOverflow = errors.New("eventsource: consumer buffer overflow")
+
+// ErrSlowConsumer is recorded as the last error of a consumer disconnected
+// for dropping or lagging behind too many messages, see
+// Settings.SlowConsumerDrops and Settings.SlowConsumerLag.
+var ErrSlowConsumer = errors.New("eventsource: slow consumer")
+
+// enqueue queues the frame for the consumer, applying the overflow policy
+// if its buffer is full, and reports whether the frame has been queued.
+// The frame expires after ttl if positive. It's called by the control
+// goroutine or the fan-out worker of the consumer, the only ones sending
+// to its buffer.
+func (es *eventSource) enqueue(c *consumer, frame []byte, ttl time.Duration) bool {
+	if es.slowConsumerLag > 0 {
+		if len(c.in) == 0 {
+			c.waitingSince = time.Now()
+		} else if es.lagging(c) {
+			es.evict(c, ErrSlowConsumer)
+			c.dropped(1)
+			return false
+		}
+	}
+
+	queued, dropped := es.push(c, newQueuedFrame(frame, ttl))
+	if dropped {
+		c.consecutiveDrops++
+		c.dropped(1)
+		es.logger.Info("Dropped a message for a consumer", "consumer", c.id, "queued", len(c.in))
+		if es.slowConsumerDrops > 0 && c.consecutiveDrops >= es.slowConsumerDrops {
+			es.evict(c, ErrSlowConsumer)
+		}
+	} else {
+		c.consecutiveDrops = 0
+	}
+	return queued
+}
+
+// priorityBufferSize is the capacity of the priority queue of consumers.
+const priorityBufferSize = 8
+
+// isPriority reports whether the message is a control message: retry
+// messages, heartbeats and shutdown notices are written before queued data
+// and aren't dropped for it.
+func isPriority(m message) bool {
+	switch m := m.(type) {
+	case *retryMessage:
+		return true
+	case *eventMessage:
+		return m.priority
+	case *commentMessage:
+		return m.priority
+	}
+	return false
+}
+
+// queue queues the frame of the message for the consumer, in the priority
+// queue if it's a control message.
+func (es *eventSource) queue(c *consumer, m message, frame []byte) bool {
+	if !isPriority(m) {
+		return es.enqueue(c, frame, messageTTL(m))
+	}
+	select {
+	case c.priority <- queuedFrame{data: frame}:
+		es.stats.queued(len(frame))
+		return true
+	default:
+		// the priority queue is full, it falls back to the data queue
+		return es.enqueue(c, frame, 0)
+	}
+}
+
+// lagging reports whether nothing has been written to the consumer for the
+// lag while messages are queued for it.
+func (es *eventSource) lagging(c *consumer) bool {
+	waiting := c.waitingSince
+	if last := time.Unix(0, atomic.LoadInt64(&c.lastActivity)); last.After(waiting) {
+		waiting = last
+	}
+	return time.Since(waiting) > es.slowConsumerLag
+}
+
+// push queues the frame applying the overflow policy, it reports whether
+// the frame has been queued and whether a message has been dropped.
+func (es *eventSource) push(c *consumer, frame queuedFrame) (queued, dropped bool) {
+	overBudget := es.overBudget(c, len(frame.data))
+	if !overBudget {
+		select {
+		case c.in <- frame:
+			es.stats.queued(len(frame.data))
+			return true, false
+		default:
+		}
+	}
+
+	switch es.overflowPolicy {
+	case DropOldest:
+		select {
+		case oldest := <-c.in:
+			es.stats.unqueued(len(oldest.data))
+		default:
+		}
+		select {
+		case c.in <- frame:
+			es.stats.queued(len(frame.data))
+			return true, true
+		default:
+		}
+	case DisconnectConsumer:
+		es.evict(c, ErrBufferOverflow)
+	case Block:
+		if overBudget {
+			break
+		}
+		timer := time.NewTimer(es.overflowTimeout)
+		defer timer.Stop()
+		select {
+		case c.in <- frame:
+			es.stats.queued(len(frame.data))
+			return true, false
+		case <-timer.C:
+		}
+	}
+	return false, true
+}
+
+// overBudget reports whether queuing size bytes more for the consumer
+// would exceed MaxQueuedBytes. Consumers with nothing queued are never
+// over budget.
+func (es *eventSource) overBudget(c *consumer, size int) bool {
+	return es.maxQueuedBytes > 0 && len(c.in) > 0 &&
+		es.stats.queuedBytesNow()+int64(size) > es.maxQueuedBytes
+}
+
+// evict marks the consumer as staled with the error, it's removed once the
+// message being dispatched has been sent to all consumers.
+func (es *eventSource) evict(c *consumer, err error) {
+	if !c.markStaled() {
+		return
+	}
+	c.setLastErr(err)
+	es.logger.Info("Disconnecting a consumer", "consumer", c.id, "error", err)
+	es.reportError(c.id, err)
+
+	es.evictedLock.Lock()
+	defer es.evictedLock.Unlock()
+
+	es.evicted = append(es.evicted, c)
+}
+
+// removeEvicted removes the evicted consumers, closing their buffers. It's
+// called by the control goroutine.
+func (es *eventSource) removeEvicted() {
+	es.evictedLock.Lock()
+	evicted := es.evicted
+	es.evicted = nil
+	es.evictedLock.Unlock()
+
+	for _, c := range evicted {
+		if es.consumers.remove(c) {
+			c.closeIn()
+		}
+	}
+}
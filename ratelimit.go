@@ -0,0 +1,102 @@
+package eventsource
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take takes a token from the bucket. If the bucket is empty, it returns
+// false and how long it takes for a token to become available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// keyedLimiter is a token bucket rate limiter per key, e.g. per client IP
+// address.
+type keyedLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newKeyedLimiter(rate float64, burst int) *keyedLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &keyedLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// take takes a token from the bucket of the key, like tokenBucket.take.
+func (l *keyedLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	// full buckets are the same as new ones, they're dropped at most once
+	// per refill period so idle keys don't pile up
+	refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) > refill {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst)
+		b.last = now
+		l.buckets[key] = b
+	}
+	l.lock.Unlock()
+
+	return b.take(now)
+}
+
+// full reports whether the bucket would be full at now.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
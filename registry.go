@@ -0,0 +1,127 @@
+package eventsource
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// registryShards is the number of shards of the consumer registry.
+const registryShards = 32
+
+// registry holds the consumers in maps sharded by consumer ID, so adding
+// and removing a consumer is O(1) and goroutines reading the registry
+// only contend with the control goroutine for one shard at a time. It's
+// modified by the control goroutine only.
+type registry struct {
+	// count is the number of consumers, accessed atomically
+	count int64
+
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	lock      sync.RWMutex
+	consumers map[ConsumerID]*consumer
+}
+
+func newRegistry() *registry {
+	r := new(registry)
+	for i := range r.shards {
+		r.shards[i].consumers = make(map[ConsumerID]*consumer)
+	}
+	return r
+}
+
+func (r *registry) shard(id ConsumerID) *registryShard {
+	return &r.shards[id%registryShards]
+}
+
+func (r *registry) add(c *consumer) {
+	s := r.shard(c.id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.consumers[c.id]; !ok {
+		s.consumers[c.id] = c
+		atomic.AddInt64(&r.count, 1)
+	}
+}
+
+// remove reports whether c has been removed, false if it wasn't there.
+func (r *registry) remove(c *consumer) bool {
+	s := r.shard(c.id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.consumers[c.id] != c {
+		return false
+	}
+	delete(s.consumers, c.id)
+	atomic.AddInt64(&r.count, -1)
+	return true
+}
+
+// update calls f holding the lock of the shard of c, so goroutines reading
+// the registry don't race with f modifying c.
+func (r *registry) update(c *consumer, f func()) {
+	s := r.shard(c.id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f()
+}
+
+// get returns the consumer with the id or nil.
+func (r *registry) get(id ConsumerID) *consumer {
+	s := r.shard(id)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.consumers[id]
+}
+
+func (r *registry) len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+// each calls f for every consumer, in no particular order, holding the
+// lock of its shard. f must not modify the registry.
+func (r *registry) each(f func(c *consumer)) {
+	for i := range r.shards {
+		r.eachInShard(i, f)
+	}
+}
+
+// eachInShard calls f for every consumer of the i-th shard like each.
+func (r *registry) eachInShard(i int, f func(c *consumer)) {
+	s := &r.shards[i]
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, c := range s.consumers {
+		f(c)
+	}
+}
+
+// latest returns the most recently connected consumer, the one with the
+// highest ID, which isn't staled or nil.
+func (r *registry) latest() *consumer {
+	var latest *consumer
+	r.each(func(c *consumer) {
+		if !c.isStaled() && (latest == nil || c.id > latest.id) {
+			latest = c
+		}
+	})
+	return latest
+}
+
+// clear removes all consumers.
+func (r *registry) clear() {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.lock.Lock()
+		s.consumers = make(map[ConsumerID]*consumer)
+		s.lock.Unlock()
+	}
+	atomic.StoreInt64(&r.count, 0)
+}
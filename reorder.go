@@ -0,0 +1,137 @@
+package eventsource
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// heldMessage is an event held by the reorder buffer until its id is the
+// next one or deadline passes.
+type heldMessage struct {
+	m        *eventMessage
+	id       uint64
+	deadline time.Time
+}
+
+// reorderBuffer releases events with numeric ids in id order. It's used by
+// the control goroutine only.
+type reorderBuffer struct {
+	window   time.Duration
+	gapEvent string
+
+	// next is the id expected next, it's unknown until the first release
+	next    uint64
+	started bool
+
+	// held is sorted by id
+	held  []heldMessage
+	timer *time.Timer
+}
+
+func newReorderBuffer(window time.Duration, gapEvent string) *reorderBuffer {
+	return &reorderBuffer{window: window, gapEvent: gapEvent}
+}
+
+// reorderID returns the numeric id of m if it can be reordered.
+func reorderID(m message) (uint64, bool) {
+	em, ok := m.(*eventMessage)
+	if !ok || em.id == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(em.id, 10, 64)
+	return id, err == nil
+}
+
+// push adds m with the numeric id to the buffer and returns the messages
+// released in order. An id lower than the next expected one came too late
+// and is released right away.
+func (r *reorderBuffer) push(m *eventMessage, id uint64, now time.Time) []message {
+	if r.started && id < r.next {
+		return []message{m}
+	}
+
+	i := sort.Search(len(r.held), func(i int) bool { return r.held[i].id > id })
+	r.held = append(r.held, heldMessage{})
+	copy(r.held[i+1:], r.held[i:])
+	r.held[i] = heldMessage{m, id, now.Add(r.window)}
+
+	return r.release(now, false)
+}
+
+// expired releases the messages held past the window.
+func (r *reorderBuffer) expired(now time.Time) []message {
+	r.timer = nil
+	return r.release(now, false)
+}
+
+// flush releases all held messages.
+func (r *reorderBuffer) flush() []message {
+	return r.release(time.Time{}, true)
+}
+
+// release pops the held messages which are next in order, and the ones
+// preceding a message held past its deadline, emitting a gap event for
+// every skipped range of ids.
+func (r *reorderBuffer) release(now time.Time, all bool) []message {
+	var released []message
+	for len(r.held) > 0 {
+		h := r.held[0]
+		if r.started && h.id == r.next {
+			released = append(released, h.m)
+		} else if all || !r.earliestDeadline().After(now) {
+			if r.started && h.id > r.next {
+				released = append(released, r.gap(r.next, h.id-1, h.m))
+			}
+			released = append(released, h.m)
+		} else {
+			break
+		}
+		r.held = r.held[1:]
+		r.next = h.id + 1
+		r.started = true
+	}
+
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	if len(r.held) > 0 {
+		r.timer = time.NewTimer(r.earliestDeadline().Sub(now))
+	}
+	return released
+}
+
+func (r *reorderBuffer) earliestDeadline() time.Time {
+	earliest := r.held[0].deadline
+	for _, h := range r.held[1:] {
+		if h.deadline.Before(earliest) {
+			earliest = h.deadline
+		}
+	}
+	return earliest
+}
+
+// gap returns the gap event for the missing ids from-to, formatted like
+// the events held.
+func (r *reorderBuffer) gap(from, to uint64, like *eventMessage) *eventMessage {
+	data := strconv.FormatUint(from, 10)
+	if to > from {
+		data += "-" + strconv.FormatUint(to, 10)
+	}
+	return &eventMessage{
+		event:      r.gapEvent,
+		data:       data,
+		alwaysData: like.alwaysData,
+		dataField:  like.dataField,
+	}
+}
+
+// expiry returns the channel signaling that a held message is past its
+// deadline, or nil if there is none.
+func (r *reorderBuffer) expiry() <-chan time.Time {
+	if r == nil || r.timer == nil {
+		return nil
+	}
+	return r.timer.C
+}
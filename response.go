@@ -0,0 +1,250 @@
+package eventsource
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotStreamable is returned when a response can be neither hijacked nor
+// flushed.
+var ErrNotStreamable = errors.New("eventsource: response can't be streamed")
+
+// responseConn streams through a ResponseWriter which can't be hijacked,
+// flushing every write, e.g. over HTTP/2 or HTTP/3 (any ResponseWriter
+// implementing http.Flusher, like the quic-go one, works). Writes block
+// while the stream flow control window is exhausted. ServeHTTP must not
+// return before the consumer goroutine exits. Reading blocks until the
+// request is canceled or the connection is closed.
+type responseConn struct {
+	resp    http.ResponseWriter
+	flusher http.Flusher
+	req     *http.Request
+
+	// comp compresses writes if the stream is compressed with enc
+	comp Compressor
+	enc  *encoder
+
+	// deadline is the write deadline, applied to the response during
+	// writes only, as an expired deadline resets an idle HTTP/2 stream
+	deadline time.Time
+
+	closeOnce sync.Once
+	closed    chan bool
+}
+
+// newResponseConn writes the response headers, including extra, and
+// returns the connection streaming the response body.
+func newResponseConn(resp http.ResponseWriter, req *http.Request, es *eventSource, extra http.Header) (*responseConn, error) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		return nil, ErrNotStreamable
+	}
+
+	conn := &responseConn{
+		resp:    resp,
+		flusher: flusher,
+		req:     req,
+		closed:  make(chan bool),
+	}
+
+	contentType, _ := es.negotiate(req)
+	header := resp.Header()
+	header.Set("Content-Type", contentType)
+	if len(es.serializers) > 0 {
+		header.Set("Vary", "Accept, Accept-Encoding")
+	} else {
+		header.Set("Vary", "Accept-Encoding")
+	}
+	if enc := es.encoder(req); enc != nil {
+		header.Set("Content-Encoding", enc.name)
+		conn.comp = enc.new(resp)
+		conn.enc = enc
+	}
+	addHeader(header, extra)
+	es.addCustomHeaders(header, req)
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return conn, nil
+}
+
+func (rc *responseConn) Write(b []byte) (int, error) {
+	if !rc.deadline.IsZero() {
+		setWriteDeadline(rc.resp, rc.deadline)
+		defer setWriteDeadline(rc.resp, time.Time{})
+	}
+
+	var n int
+	var err error
+	if rc.comp != nil {
+		if n, err = rc.comp.Write(b); err == nil {
+			err = rc.comp.Flush()
+		}
+	} else {
+		n, err = rc.resp.Write(b)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	rc.flusher.Flush()
+	return n, nil
+}
+
+func (rc *responseConn) Read(b []byte) (int, error) {
+	select {
+	case <-rc.req.Context().Done():
+	case <-rc.closed:
+	}
+	return 0, io.EOF
+}
+
+func (rc *responseConn) Close() error {
+	var err error
+	rc.closeOnce.Do(func() {
+		if rc.comp != nil {
+			err = rc.comp.Close()
+			if rc.enc.release != nil {
+				rc.enc.release(rc.comp)
+			}
+			rc.flusher.Flush()
+		}
+		close(rc.closed)
+	})
+	return err
+}
+
+func (rc *responseConn) LocalAddr() net.Addr {
+	if addr, ok := rc.req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return nil
+}
+
+func (rc *responseConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// SetDeadline only sets the write deadline, reading ends with the request.
+func (rc *responseConn) SetDeadline(t time.Time) error {
+	return rc.SetWriteDeadline(t)
+}
+
+func (rc *responseConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the following writes, it has no
+// effect if the ResponseWriter doesn't support it.
+func (rc *responseConn) SetWriteDeadline(t time.Time) error {
+	rc.deadline = t
+	return nil
+}
+
+// addCustomHeaders adds the header lines returned by the custom headers
+// function to header.
+func (es *eventSource) addCustomHeaders(header http.Header, req *http.Request) {
+	if es.customHeadersFunc == nil {
+		return
+	}
+	for _, line := range es.customHeadersFunc(req) {
+		if name, value, ok := strings.Cut(string(line), ":"); ok {
+			header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+}
+
+// acceptMethod reports whether req is a GET request to be streamed to.
+// CORS preflight requests are answered with the custom headers, other
+// methods are rejected.
+func (es *eventSource) acceptMethod(resp http.ResponseWriter, req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet:
+		return true
+	case http.MethodOptions:
+		header := resp.Header()
+		header.Set("Allow", "GET, OPTIONS")
+		if req.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", "GET")
+			if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				header.Set("Access-Control-Allow-Headers", requested)
+			}
+		}
+		es.cors.addHeaders(header, req, true)
+		es.addCustomHeaders(header, req)
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		resp.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(resp, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+	return false
+}
+
+// authorized reports whether req passes the Authorize hook, rejecting it
+// otherwise.
+func (es *eventSource) authorized(resp http.ResponseWriter, req *http.Request) bool {
+	if es.authorize == nil {
+		return true
+	}
+	status, err := es.authorize(req)
+	if err == nil {
+		return true
+	}
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	es.cors.addHeaders(resp.Header(), req, false)
+	http.Error(resp, http.StatusText(status), status)
+	return false
+}
+
+// streamHeader returns the status code and extra headers of the response
+// to req: the CORS headers, the ones returned by the Headers hook and the
+// streaming ones.
+func (es *eventSource) streamHeader(req *http.Request) (int, http.Header) {
+	header := make(http.Header)
+	es.cors.addHeaders(header, req, false)
+	status := http.StatusOK
+	if es.headersFunc != nil {
+		var extra http.Header
+		status, extra = es.headersFunc(req)
+		if status == 0 {
+			status = http.StatusOK
+		}
+		addHeader(header, extra)
+	}
+	if es.streamingHeaders {
+		if header.Get("Cache-Control") == "" {
+			header.Set("Cache-Control", "no-cache")
+		}
+		if header.Get("X-Accel-Buffering") == "" {
+			header.Set("X-Accel-Buffering", "no")
+		}
+	}
+	return status, header
+}
+
+// writeStatus answers req with the status code instead of streaming.
+func (es *eventSource) writeStatus(resp http.ResponseWriter, req *http.Request, status int, header http.Header) {
+	addHeader(resp.Header(), header)
+	es.addCustomHeaders(resp.Header(), req)
+	if status >= http.StatusBadRequest {
+		http.Error(resp, http.StatusText(status), status)
+		return
+	}
+	resp.WriteHeader(status)
+}
+
+// addHeader adds the values of extra to header, canonicalizing the names.
+func addHeader(header, extra http.Header) {
+	for name, values := range extra {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+}
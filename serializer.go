@@ -0,0 +1,90 @@
+package eventsource
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sseContentType is the content type of the built-in SSE framing.
+const sseContentType = "text/event-stream"
+
+// Serializer frames messages for a streaming format other than SSE. It's
+// registered in Settings.Serializers for the content type it produces.
+// Methods are called from the control goroutine, or concurrently by the
+// fan-out workers, and shouldn't block.
+type Serializer interface {
+	// SerializeEvent returns the frame of an event.
+	SerializeEvent(data, event, id string) []byte
+
+	// SerializeRetry returns the frame of a reconnection delay, or nil if
+	// the format has no such notion.
+	SerializeRetry(retry time.Duration) []byte
+
+	// SerializeComment returns the frame of a comment (e.g. a heartbeat),
+	// or nil if the format has no such notion.
+	SerializeComment(comment string) []byte
+}
+
+// negotiate picks the content type and serializer for req by matching its
+// Accept header against the registered serializers. The serializer is nil
+// for SSE, which is picked if nothing else matches.
+func (es *eventSource) negotiate(req *http.Request) (string, Serializer) {
+	if req == nil || len(es.serializers) == 0 {
+		return sseContentType, nil
+	}
+
+	contentType, serializer, best := sseContentType, Serializer(nil), 0.0
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		// the first of the equally preferred types wins
+		if q <= best {
+			continue
+		}
+		if mediaType == sseContentType || mediaType == "text/*" || mediaType == "*/*" {
+			contentType, serializer, best = sseContentType, nil, q
+		} else if s, ok := es.serializers[mediaType]; ok {
+			contentType, serializer, best = mediaType, s, q
+		}
+	}
+	return contentType, serializer
+}
+
+// serialize returns the frame of m for serializer s, or nil if m can't be
+// serialized. A nil s stands for SSE.
+func (es *eventSource) serialize(s Serializer, m message) []byte {
+	if s == nil {
+		return es.frame(m)
+	}
+
+	switch m := m.(type) {
+	case *eventMessage:
+		return s.SerializeEvent(m.data, m.event, m.id)
+	case *retryMessage:
+		return s.SerializeRetry(m.retry)
+	case *commentMessage:
+		return s.SerializeComment(m.comment)
+	case *batchMessage:
+		var frame []byte
+		for _, em := range m.events {
+			frame = append(frame, es.serialize(s, em)...)
+		}
+		return frame
+	case *variantMessage:
+		if em, ok := m.variants[""]; ok {
+			return es.serialize(s, em)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package eventsource
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of EventSource statistics.
+type Stats struct {
+	// FirstConnections is the number of accepted connections without a
+	// Last-Event-ID header.
+	FirstConnections uint64
+
+	// Reconnections is the number of accepted connections with a
+	// Last-Event-ID header, i.e. clients reconnecting after losing their
+	// connection.
+	Reconnections uint64
+
+	// Goroutines is the number of running consumer goroutines.
+	Goroutines int64
+
+	// WriteLatency summarizes how long writes to consumer connections
+	// take.
+	WriteLatency LatencyStats
+
+	// QueuedBytes is the total size of messages queued for consumers.
+	QueuedBytes int64
+
+	// Expired is the number of queued events skipped because they
+	// expired, see Settings.MessageTTL.
+	Expired uint64
+
+	// FanOut has the delivery counts of every fan-out worker, it's nil
+	// unless Settings.FanOutWorkers is more than 1.
+	FanOut []PartitionStats
+}
+
+// PartitionStats counts the broadcast deliveries of a fan-out worker to
+// its partition of the consumers.
+type PartitionStats struct {
+	// Delivered is the number of messages queued for consumers.
+	Delivered uint64
+
+	// Dropped is the number of messages dropped because consumer buffers
+	// were full.
+	Dropped uint64
+}
+
+// LatencyStats summarizes observed latencies. Percentiles are estimated
+// by the upper bounds of power-of-two buckets, so they can overestimate
+// by up to a factor of two.
+type LatencyStats struct {
+	// Count is the number of observations.
+	Count uint64
+
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// latencyBuckets is the number of histogram buckets. Bucket i counts
+// latencies up to 1µs << i, the last bucket counts all longer ones.
+const latencyBuckets = 25
+
+// latencyHistogram is a fixed-bucket latency histogram. Its buckets are
+// accessed atomically.
+type latencyHistogram struct {
+	buckets [latencyBuckets]uint64
+}
+
+func latencyBucket(d time.Duration) int {
+	for i := 0; i < latencyBuckets-1; i++ {
+		if d <= time.Microsecond<<uint(i) {
+			return i
+		}
+	}
+	return latencyBuckets - 1
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	atomic.AddUint64(&h.buckets[latencyBucket(d)], 1)
+}
+
+// snapshot summarizes the histogram. If reset is set, observations are
+// cleared.
+func (h *latencyHistogram) snapshot(reset bool) LatencyStats {
+	var counts [latencyBuckets]uint64
+	var ls LatencyStats
+	for i := range h.buckets {
+		if reset {
+			counts[i] = atomic.SwapUint64(&h.buckets[i], 0)
+		} else {
+			counts[i] = atomic.LoadUint64(&h.buckets[i])
+		}
+		ls.Count += counts[i]
+	}
+
+	percentile := func(q float64) time.Duration {
+		rank := uint64(q*float64(ls.Count) + 0.5)
+		if rank < 1 {
+			rank = 1
+		}
+		var seen uint64
+		for i, n := range counts {
+			seen += n
+			if seen >= rank {
+				return time.Microsecond << uint(i)
+			}
+		}
+		return 0
+	}
+	if ls.Count > 0 {
+		ls.P50 = percentile(0.50)
+		ls.P95 = percentile(0.95)
+		ls.P99 = percentile(0.99)
+	}
+	return ls
+}
+
+// stats collects EventSource statistics. Its fields are accessed
+// atomically.
+type stats struct {
+	firstConnections uint64
+	reconnections    uint64
+	goroutines       int64
+	queuedBytes      int64
+	expired          uint64
+	writeLatency     latencyHistogram
+	partitions       []partitionCounts
+}
+
+func (s *stats) connected(reconnection bool) {
+	if reconnection {
+		atomic.AddUint64(&s.reconnections, 1)
+	} else {
+		atomic.AddUint64(&s.firstConnections, 1)
+	}
+}
+
+// reserveGoroutine counts a new consumer goroutine unless there are max
+// goroutines already. Zero max means no limit.
+func (s *stats) reserveGoroutine(max int64) bool {
+	if atomic.AddInt64(&s.goroutines, 1) > max && max > 0 {
+		atomic.AddInt64(&s.goroutines, -1)
+		return false
+	}
+	return true
+}
+
+func (s *stats) releaseGoroutine() {
+	atomic.AddInt64(&s.goroutines, -1)
+}
+
+func (s *stats) queued(size int) {
+	atomic.AddInt64(&s.queuedBytes, int64(size))
+}
+
+func (s *stats) unqueued(size int) {
+	atomic.AddInt64(&s.queuedBytes, -int64(size))
+}
+
+func (s *stats) expire() {
+	atomic.AddUint64(&s.expired, 1)
+}
+
+func (s *stats) goroutinesNow() int64 {
+	return atomic.LoadInt64(&s.goroutines)
+}
+
+func (s *stats) queuedBytesNow() int64 {
+	return atomic.LoadInt64(&s.queuedBytes)
+}
+
+// snapshot takes a Stats snapshot. If reset is set, latency observations
+// are cleared.
+func (s *stats) snapshot(reset bool) Stats {
+	st := Stats{
+		FirstConnections: atomic.LoadUint64(&s.firstConnections),
+		Reconnections:    atomic.LoadUint64(&s.reconnections),
+		Goroutines:       atomic.LoadInt64(&s.goroutines),
+		QueuedBytes:      s.queuedBytesNow(),
+		Expired:          atomic.LoadUint64(&s.expired),
+		WriteLatency:     s.writeLatency.snapshot(reset),
+	}
+	if len(s.partitions) > 0 {
+		st.FanOut = make([]PartitionStats, len(s.partitions))
+		for i := range s.partitions {
+			st.FanOut[i] = s.partitions[i].snapshot()
+		}
+	}
+	return st
+}
@@ -0,0 +1,35 @@
+package eventsource
+
+// stickyEvents keeps the last broadcast event of every event type for
+// consumers connecting later. It's used by the control goroutine only.
+type stickyEvents struct {
+	// types are the event types, the most recently sent last
+	types []string
+	last  map[string]*eventMessage
+}
+
+func newStickyEvents() *stickyEvents {
+	return &stickyEvents{last: make(map[string]*eventMessage)}
+}
+
+func (s *stickyEvents) record(m *eventMessage) {
+	if _, ok := s.last[m.event]; ok {
+		for i, event := range s.types {
+			if event == m.event {
+				s.types = append(s.types[:i], s.types[i+1:]...)
+				break
+			}
+		}
+	}
+	s.types = append(s.types, m.event)
+	s.last[m.event] = m
+}
+
+// events returns the kept events in the order they were sent.
+func (s *stickyEvents) events() []*eventMessage {
+	events := make([]*eventMessage, len(s.types))
+	for i, event := range s.types {
+		events[i] = s.last[event]
+	}
+	return events
+}
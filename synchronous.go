@@ -0,0 +1,302 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SyncEventSource is an event source without background goroutines or
+// buffering: messages are written to consumer connections inline by the
+// sending goroutine. It's meant for tests and tools serving a few
+// consumers, where deterministic delivery matters more than scalability.
+type SyncEventSource struct {
+	es *eventSource
+
+	lock      sync.Mutex
+	consumers []*syncConsumer
+	closed    bool
+}
+
+type syncConsumer struct {
+	id          ConsumerID
+	conn        net.Conn
+	w           io.WriteCloser
+	contentType string
+	serializer  Serializer
+}
+
+// NewSynchronous creates a synchronous event source. Settings related to
+// the control goroutine and consumer goroutines (IdleTimeout,
+// AddBufferSize, MaxGoroutines, ReorderWindow, WatchClientClose and the
+// like) are ignored.
+func NewSynchronous(settings *Settings, customHeadersFunc func(*http.Request) [][]byte) *SyncEventSource {
+	return &SyncEventSource{es: newEventSource(settings, customHeadersFunc)}
+}
+
+// ServeHTTP hijacks the connection and writes the response header block.
+// It returns immediately, events are written by the Send methods. If the
+// connection can't be hijacked, e.g. over HTTP/2, events are streamed
+// through the response and ServeHTTP returns once the consumer is closed
+// or the client goes away.
+func (s *SyncEventSource) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !s.es.acceptMethod(resp, req) || !s.es.authorized(resp, req) {
+		return
+	}
+
+	status, header := s.es.streamHeader(req)
+	if status != http.StatusOK {
+		s.es.writeStatus(resp, req, status, header)
+		return
+	}
+
+	c, err := s.connect(resp, req, header)
+	if err != nil {
+		s.es.logger.Error("Can't create connection to a consumer", "remote_addr", req.RemoteAddr, "error", err)
+		return
+	}
+	if c == nil {
+		// the event source is closed
+		return
+	}
+
+	s.es.stats.connected(req.Header.Get("Last-Event-ID") != "")
+	// the lock isn't held, so the hook can send
+	if s.es.onConnect != nil {
+		s.es.onConnect(req, c.id)
+	}
+
+	if rc, ok := c.conn.(*responseConn); ok {
+		// the response can't be used once the handler returns
+		select {
+		case <-req.Context().Done():
+			s.remove(c)
+		case <-rc.closed:
+		}
+	}
+}
+
+// connect takes over the connection, hijacking it or streaming through the
+// response, writes the response headers and adds the consumer. It returns
+// a nil consumer if the event source is closed.
+func (s *SyncEventSource) connect(resp http.ResponseWriter, req *http.Request, header http.Header) (*syncConsumer, error) {
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		return s.connectResponse(resp, req, header)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err == http.ErrNotSupported {
+		return s.connectResponse(resp, req, header)
+	}
+	if err != nil {
+		s.es.reportError(0, err)
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return nil, nil
+	}
+
+	c := &syncConsumer{id: s.es.nextConsumerID(), conn: conn, w: conn}
+	c.contentType, c.serializer = s.es.negotiate(req)
+	headers, enc := s.es.responseHeaders(req, c.contentType, header)
+	if enc != nil {
+		c.w = newCompressConn(conn, enc)
+	}
+	conn.SetWriteDeadline(time.Now().Add(s.es.timeout))
+	if _, err := conn.Write(headers); err != nil {
+		s.es.reportError(c.id, err)
+		conn.Close()
+		return nil, err
+	}
+	s.consumers = append(s.consumers, c)
+	return c, nil
+}
+
+// connectResponse streams through the response, like newConsumer does for
+// responses which can't be hijacked.
+func (s *SyncEventSource) connectResponse(resp http.ResponseWriter, req *http.Request, header http.Header) (*syncConsumer, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		http.Error(resp, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, nil
+	}
+
+	rc, err := newResponseConn(resp, req, s.es, header)
+	if err != nil {
+		s.es.reportError(0, err)
+		return nil, err
+	}
+	c := &syncConsumer{id: s.es.nextConsumerID(), conn: rc, w: rc}
+	c.contentType, c.serializer = s.es.negotiate(req)
+	s.consumers = append(s.consumers, c)
+	return c, nil
+}
+
+// remove closes and removes the consumer whose client went away, unless
+// it has been removed already.
+func (s *SyncEventSource) remove(c *syncConsumer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, other := range s.consumers {
+		if other == c {
+			s.consumers = append(s.consumers[:i], s.consumers[i+1:]...)
+			c.w.Close()
+			if s.es.onDisconnect != nil {
+				s.es.onDisconnect(c.id, ErrClientClosed)
+			}
+			return
+		}
+	}
+}
+
+// SendEventMessage writes an event to all consumers before returning.
+// Consumers failing the write are closed and removed, the first error is
+// returned.
+func (s *SyncEventSource) SendEventMessage(data, event, id string) error {
+	return s.Send(Event{ID: id, Type: event, Data: data})
+}
+
+// Send writes an event to all consumers before returning, see
+// SendEventMessage.
+func (s *SyncEventSource) Send(e Event) error {
+	if err := s.es.validate(e.Type, e.ID); err != nil {
+		return err
+	}
+	return s.send(s.es.newEvent(e))
+}
+
+// SendEvents writes events to all consumers in a single write each before
+// returning, see SendEventMessage.
+func (s *SyncEventSource) SendEvents(events []Event) error {
+	bm, err := s.es.newBatch(events)
+	if err != nil || bm == nil {
+		return err
+	}
+	return s.send(bm)
+}
+
+// SendJSON writes v encoded as JSON to all consumers before returning,
+// see SendEventMessage.
+func (s *SyncEventSource) SendJSON(v interface{}, event, id string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.SendEventMessage(string(data), event, id)
+}
+
+// SendRetryMessage writes a retry message to all consumers before
+// returning, see SendEventMessage.
+func (s *SyncEventSource) SendRetryMessage(t time.Duration) error {
+	return s.send(&retryMessage{s.es.clampRetry(t)})
+}
+
+// SendComment writes a comment to all consumers before returning, see
+// SendEventMessage.
+func (s *SyncEventSource) SendComment(text string) error {
+	return s.send(&commentMessage{comment: text})
+}
+
+func (s *SyncEventSource) send(m message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	s.es.sequence(m)
+
+	var firstErr error
+	frames := make(map[string][]byte)
+	alive := s.consumers[:0]
+	for _, c := range s.consumers {
+		frame, ok := frames[c.contentType]
+		if !ok {
+			frame = s.es.serialize(c.serializer, m)
+			frames[c.contentType] = frame
+		}
+		if len(frame) == 0 {
+			alive = append(alive, c)
+			continue
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(s.es.timeout))
+		start := time.Now()
+		_, err := c.w.Write(frame)
+		s.es.stats.writeLatency.observe(time.Since(start))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			s.es.reportError(c.id, err)
+			c.w.Close()
+			if s.es.onDisconnect != nil {
+				s.es.onDisconnect(c.id, err)
+			}
+			continue
+		}
+		if s.es.onFrame != nil {
+			s.es.onFrame(c.id, len(frame))
+		}
+		alive = append(alive, c)
+	}
+	for i := len(alive); i < len(s.consumers); i++ {
+		s.consumers[i] = nil
+	}
+	s.consumers = alive
+
+	return firstErr
+}
+
+// ConsumersCount returns the number of connected consumers.
+func (s *SyncEventSource) ConsumersCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.consumers)
+}
+
+// LastEventID returns the id of the last event sent, "" if none had an id.
+func (s *SyncEventSource) LastEventID() string {
+	return s.es.LastEventID()
+}
+
+// Stats returns the event source statistics.
+func (s *SyncEventSource) Stats() Stats {
+	return s.es.stats.snapshot(false)
+}
+
+// StatsAndReset returns the event source statistics and clears write
+// latency observations, see EventSource.StatsAndReset.
+func (s *SyncEventSource) StatsAndReset() Stats {
+	return s.es.stats.snapshot(true)
+}
+
+// Close closes all consumer connections. Sending afterwards returns
+// ErrClosed.
+func (s *SyncEventSource) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, c := range s.consumers {
+		c.w.Close()
+		if s.es.onDisconnect != nil {
+			s.es.onDisconnect(c.id, nil)
+		}
+	}
+	s.consumers = nil
+}
@@ -0,0 +1,145 @@
+package eventsource
+
+import (
+	"sort"
+	"time"
+)
+
+// throttledType is the throttling state of an event type.
+type throttledType struct {
+	// until is when the window started by the last event sent ends
+	until time.Time
+
+	// held is the latest event received within the window, or nil, seq
+	// orders it among events of other types
+	held *eventMessage
+	seq  uint64
+}
+
+// throttle sends at most one event of every throttled type per window, the
+// latest one received within the window is sent when it ends. It's used by
+// the control goroutine only.
+type throttle struct {
+	windows map[string]time.Duration
+	types   map[string]*throttledType
+	seq     uint64
+	timer   *time.Timer
+}
+
+func newThrottle(windows map[string]time.Duration) *throttle {
+	t := &throttle{
+		windows: make(map[string]time.Duration, len(windows)),
+		types:   make(map[string]*throttledType),
+	}
+	for event, window := range windows {
+		if window > 0 {
+			t.windows[event] = window
+		}
+	}
+	return t
+}
+
+// hold reports whether m is held until the window of its type ends,
+// replacing the event held before. Events of a type without a window
+// started are sent right away, starting it.
+func (t *throttle) hold(m message, now time.Time) bool {
+	em, ok := m.(*eventMessage)
+	if !ok {
+		return false
+	}
+	window, ok := t.windows[em.event]
+	if !ok {
+		return false
+	}
+
+	tt := t.types[em.event]
+	if tt == nil || !now.Before(tt.until) {
+		t.types[em.event] = &throttledType{until: now.Add(window)}
+		return false
+	}
+	if tt.held == nil {
+		t.seq++
+		tt.seq = t.seq
+		tt.held = em
+		t.schedule(now)
+		return true
+	}
+	tt.held = em
+	return true
+}
+
+// expired releases the events held past the end of their window, in the
+// order they have been held, starting a new window for their types.
+func (t *throttle) expired(now time.Time) []message {
+	t.timer = nil
+	var released []*throttledType
+	for event, tt := range t.types {
+		if now.Before(tt.until) {
+			continue
+		}
+		if tt.held == nil {
+			delete(t.types, event)
+			continue
+		}
+		released = append(released, tt)
+	}
+	sort.Slice(released, func(i, j int) bool {
+		return released[i].seq < released[j].seq
+	})
+
+	messages := make([]message, 0, len(released))
+	for _, tt := range released {
+		messages = append(messages, tt.held)
+		tt.until = now.Add(t.windows[tt.held.event])
+		tt.held = nil
+	}
+	t.schedule(now)
+	return messages
+}
+
+// flush releases all held events.
+func (t *throttle) flush() []message {
+	var released []*throttledType
+	for _, tt := range t.types {
+		if tt.held != nil {
+			released = append(released, tt)
+		}
+	}
+	sort.Slice(released, func(i, j int) bool {
+		return released[i].seq < released[j].seq
+	})
+
+	messages := make([]message, 0, len(released))
+	for _, tt := range released {
+		messages = append(messages, tt.held)
+		tt.held = nil
+	}
+	return messages
+}
+
+// schedule sets the timer to the earliest end of a window with an event
+// held.
+func (t *throttle) schedule(now time.Time) {
+	var earliest time.Time
+	for _, tt := range t.types {
+		if tt.held != nil && (earliest.IsZero() || tt.until.Before(earliest)) {
+			earliest = tt.until
+		}
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if !earliest.IsZero() {
+		t.timer = time.NewTimer(earliest.Sub(now))
+	}
+}
+
+// expiry returns the channel signaling that the window of a held event has
+// ended, or nil if there is none.
+func (t *throttle) expiry() <-chan time.Time {
+	if t == nil || t.timer == nil {
+		return nil
+	}
+	return t.timer.C
+}